@@ -2,20 +2,42 @@
 package cluster
 
 import (
-	"math" // 用于获取 MaxInt32/MaxUint32
-	"time" // 时间处理
+	"bytes"        // 消息编码缓冲
+	"encoding/gob" // 集群消息编码
+	"errors"       // 错误处理
+	"math"         // 用于获取 MaxInt32/MaxUint32
+	"sync"         // 互斥锁
+	"sync/atomic"  // 原子操作
+	"time"         // 时间处理
 
 	"github.com/name5566/leaf/conf"    // Leaf 框架配置
+	"github.com/name5566/leaf/log"     // Leaf 框架日志
 	"github.com/name5566/leaf/network" // Leaf 框架网络库
 )
 
 var (
 	server  *network.TCPServer   // 集群服务端实例
 	clients []*network.TCPClient // 集群客户端列表
+
+	discovery      Discovery                     // 集群成员发现
+	mutexClients   sync.Mutex                    // 保护 dynamicClients
+	dynamicClients map[string]*network.TCPClient // 成员发现得到的地址 -> 客户端
 )
 
+// SetDiscovery 设置集群成员发现，必须在 cluster.Init 之前调用
+// 未设置时如果配置了 conf.ClusterFile 则使用 FileDiscovery
+func SetDiscovery(d Discovery) {
+	discovery = d
+}
+
 // Init 初始化集群服务端和客户端
 func Init() {
+	// 超时不大于心跳间隔时正常的节点也会被断开
+	if conf.HeartbeatInterval > 0 && conf.HeartbeatTimeout > 0 && conf.HeartbeatTimeout <= conf.HeartbeatInterval {
+		conf.HeartbeatTimeout = 3 * conf.HeartbeatInterval
+		log.Release("invalid HeartbeatTimeout, reset to %v", conf.HeartbeatTimeout)
+	}
+
 	// 如果配置了 ListenAddr，则启动 TCPServer
 	if conf.ListenAddr != "" {
 		server = new(network.TCPServer)               // 创建 TCPServer 实例
@@ -25,28 +47,107 @@ func Init() {
 		server.LenMsgLen = 4                          // 消息长度字段长度
 		server.MaxMsgLen = math.MaxUint32             // 最大消息长度
 		server.NewAgent = newAgent                    // 新连接回调
+		server.CertFile = conf.ClusterCertFile        // TLS 证书
+		server.KeyFile = conf.ClusterKeyFile          // TLS 证书私钥
+		server.CAFile = conf.ClusterCAFile            // 验证对端证书的 CA
 
 		server.Start() // 启动服务端
 	}
 
 	// 遍历配置的连接地址，创建 TCP 客户端
 	for _, addr := range conf.ConnAddrs {
-		client := new(network.TCPClient)              // 创建 TCPClient 实例
-		client.Addr = addr                            // 设置服务器地址
-		client.ConnNum = 1                            // 每个地址连接数量
-		client.ConnectInterval = 3 * time.Second      // 重连间隔
-		client.PendingWriteNum = conf.PendingWriteNum // 待发送队列长度
-		client.LenMsgLen = 4                          // 消息长度字段长度
-		client.MaxMsgLen = math.MaxUint32             // 最大消息长度
-		client.NewAgent = newAgent                    // 新连接回调
-
-		client.Start()                    // 启动客户端
-		clients = append(clients, client) // 添加到客户端列表
+		clients = append(clients, newClient(addr)) // 添加到客户端列表
+	}
+
+	// 启动成员发现
+	if discovery == nil && conf.ClusterFile != "" {
+		discovery = &FileDiscovery{Path: conf.ClusterFile}
 	}
+	if discovery != nil {
+		dynamicClients = make(map[string]*network.TCPClient)
+		discovery.Start(updateMembers)
+	}
+}
+
+// clusterTLS 判断集群连接是否使用 TLS
+func clusterTLS() bool {
+	return conf.ClusterCertFile != "" || conf.ClusterKeyFile != "" || conf.ClusterCAFile != "" || conf.ClusterServerName != ""
+}
+
+// newClient 创建并启动连接 addr 的 TCP 客户端
+func newClient(addr string) *network.TCPClient {
+	client := new(network.TCPClient)              // 创建 TCPClient 实例
+	client.Addr = addr                            // 设置服务器地址
+	client.ConnNum = 1                            // 每个地址连接数量
+	client.ConnectInterval = 3 * time.Second      // 重连间隔
+	client.AutoReconnect = true                   // 断线后自动重连
+	client.PendingWriteNum = conf.PendingWriteNum // 待发送队列长度
+	client.LenMsgLen = 4                          // 消息长度字段长度
+	client.MaxMsgLen = math.MaxUint32             // 最大消息长度
+	client.NewAgent = newAgent                    // 新连接回调
+	client.TLS = clusterTLS()                     // 设置了任一 TLS 配置时使用 TLS
+	client.CertFile = conf.ClusterCertFile        // TLS 证书
+	client.KeyFile = conf.ClusterKeyFile          // TLS 证书私钥
+	client.CAFile = conf.ClusterCAFile            // 验证对端证书的 CA
+	client.ServerName = conf.ClusterServerName    // 验证的服务端证书名字
+
+	client.Start() // 启动客户端
+	return client
+}
+
+// updateMembers 根据成员发现的结果连接新增节点、断开移除的节点
+func updateMembers(addrs []string) {
+	var removed []*network.TCPClient
+	mutexClients.Lock()
+	defer func() {
+		mutexClients.Unlock()
+		// Close 等待连接退出，不持有锁
+		for _, client := range removed {
+			client.Close()
+		}
+	}()
+	if dynamicClients == nil {
+		return
+	}
+
+	members := make(map[string]bool)
+	for _, addr := range addrs {
+		// 成员文件通常所有节点共用，跳过自己和静态配置的地址
+		if addr == conf.ListenAddr || isStaticAddr(addr) {
+			continue
+		}
+		members[addr] = true
+		if _, ok := dynamicClients[addr]; !ok {
+			log.Release("cluster member added: %v", addr)
+			dynamicClients[addr] = newClient(addr)
+		}
+	}
+
+	for addr, client := range dynamicClients {
+		if !members[addr] {
+			log.Release("cluster member removed: %v", addr)
+			removed = append(removed, client)
+			delete(dynamicClients, addr)
+		}
+	}
+}
+
+// isStaticAddr 判断 addr 是否在 conf.ConnAddrs 中
+func isStaticAddr(addr string) bool {
+	for _, a := range conf.ConnAddrs {
+		if a == addr {
+			return true
+		}
+	}
+	return false
 }
 
 // Destroy 关闭集群服务端和所有客户端
 func Destroy() {
+	// 停止成员发现
+	if discovery != nil {
+		discovery.Stop()
+	}
 	// 关闭服务端
 	if server != nil {
 		server.Close()
@@ -55,22 +156,153 @@ func Destroy() {
 	for _, client := range clients {
 		client.Close()
 	}
+	mutexClients.Lock()
+	removed := dynamicClients
+	dynamicClients = nil
+	mutexClients.Unlock()
+	for _, client := range removed {
+		client.Close()
+	}
 }
 
 // Agent 封装 TCP 连接
 type Agent struct {
-	conn *network.TCPConn // TCP 连接对象
+	sync.Mutex
+	conn      *network.TCPConn        // TCP 连接对象
+	peer      *Peer                   // 握手完成后对端节点
+	seq       uint32                  // 最近一次请求的序号
+	pending   map[uint32]*pendingCall // 等待返回的请求
+	closeFlag bool                    // 连接是否已关闭
+	lastRecv  int64                   // 最近一次收到消息的时间（UnixNano）
+	closeSig  chan struct{}           // Run 结束时关闭，用于停止心跳
+	requests  chan struct{}           // 正在执行的同步调用，容量为 conf.ClusterMaxRequests
+	dispatch  *dispatcher             // 按顺序把消息交给本地模块，不阻塞读协程
+}
+
+// pendingCall 表示一次等待返回的远程调用
+type pendingCall struct {
+	n        int           // 返回值类型 0/1/2
+	chanRet  chan *RetInfo // 返回结果通道
+	cb       interface{}   // 回调
+	deadline time.Time     // 超时时间，为零时不超时
 }
 
 // newAgent 创建新的 Agent 实例
 func newAgent(conn *network.TCPConn) network.Agent {
 	a := new(Agent)
 	a.conn = conn
+	a.pending = make(map[uint32]*pendingCall)
+	a.closeSig = make(chan struct{})
+	a.dispatch = newDispatcher()
+	if conf.ClusterMaxRequests > 0 {
+		a.requests = make(chan struct{}, conf.ClusterMaxRequests)
+	}
 	return a
 }
 
-// Run 实现 network.Agent 接口的 Run 方法
-func (a *Agent) Run() {}
+// Run 实现 network.Agent 接口的 Run 方法，循环读取并处理集群消息
+func (a *Agent) Run() {
+	// 连接建立后先交换节点名字
+	err := a.writeMsg(&message{Type: msgHandshake, Name: localName(), Role: conf.NodeRole, Instance: instance})
+	if err != nil {
+		log.Error("write handshake error: %v", err)
+		return
+	}
 
-// OnClose 实现 network.Agent 接口的 OnClose 方法
-func (a *Agent) OnClose() {}
+	atomic.StoreInt64(&a.lastRecv, time.Now().UnixNano())
+	defer close(a.closeSig)
+	if conf.HeartbeatInterval > 0 {
+		go a.heartbeat(conf.HeartbeatInterval, conf.HeartbeatTimeout)
+	}
+	if conf.ClusterCallTimeout > 0 {
+		go a.checkTimeout()
+	}
+
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			log.Debug("read message: %v", err)
+			break
+		}
+		atomic.StoreInt64(&a.lastRecv, time.Now().UnixNano())
+
+		m := new(message)
+		err = gob.NewDecoder(bytes.NewReader(data)).Decode(m)
+		if err != nil {
+			// 消息边界由 TCPConn 保证，单条消息解码失败不影响后续消息
+			log.Error("decode message error: %v", err)
+			continue
+		}
+
+		if m.Type != msgHandshake && m.Type != msgPing && m.Type != msgPong && !a.handshaked() {
+			// 握手完成前不知道对端节点，丢弃其他消息
+			log.Error("message %v before handshake from %v", m.Type, a.conn.RemoteAddr())
+			continue
+		}
+
+		switch m.Type {
+		case msgHandshake:
+			a.handleHandshake(m)
+		case msgRequest:
+			a.handleRequest(m)
+		case msgResponse:
+			a.handleResponse(m)
+		case msgPing:
+			a.writeMsg(&message{Type: msgPong})
+		case msgPong:
+		case msgSessionOpen, msgSessionData, msgSessionClose, msgSessionReply, msgSessionKick:
+			a.dispatch.push(func() { a.handleSession(m) })
+		default:
+			log.Error("invalid message type: %v", m.Type)
+		}
+	}
+}
+
+// OnClose 实现 network.Agent 接口的 OnClose 方法，结束所有等待中的调用
+func (a *Agent) OnClose() {
+	// 先派发完已收到的消息，再通知节点断开
+	a.dispatch.close()
+	removeAgent(a)
+
+	a.Lock()
+	a.closeFlag = true
+	pending := a.pending
+	a.pending = nil
+	a.Unlock()
+
+	for _, c := range pending {
+		c.chanRet <- &RetInfo{err: errors.New("cluster agent closed"), cb: c.cb}
+	}
+}
+
+// heartbeat 定时发送心跳，并断开超时未收到消息的连接
+func (a *Agent) heartbeat(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.closeSig:
+			return
+		case <-ticker.C:
+			last := time.Unix(0, atomic.LoadInt64(&a.lastRecv))
+			if timeout > 0 && time.Since(last) > timeout {
+				// 对端可能已经半开，直接销毁连接使读操作返回
+				log.Release("heartbeat timeout: %v", a.conn.RemoteAddr())
+				a.conn.Destroy()
+				return
+			}
+			a.writeMsg(&message{Type: msgPing})
+		}
+	}
+}
+
+// writeMsg 编码并发送一条集群消息
+func (a *Agent) writeMsg(m *message) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(m)
+	if err != nil {
+		return err
+	}
+	return a.conn.WriteMsg(buf.Bytes())
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/name5566/leaf/log"
+	"gopkg.in/yaml.v2"
+)
+
+// Discovery 提供集群成员地址
+// 每当成员变化时以完整的地址列表调用 update，Stop 返回后不再调用
+type Discovery interface {
+	Start(update func(addrs []string))
+	Stop()
+}
+
+// FileDiscovery 定时读取本地成员文件，文件内容变化时更新集群成员
+// 文件扩展名为 .yaml 或 .yml 时按 YAML 解析，否则按 JSON 解析，格式为
+//
+//	{"ConnAddrs": ["127.0.0.1:3564", "127.0.0.1:3565"]}
+type FileDiscovery struct {
+	Path     string        // 成员文件路径
+	Interval time.Duration // 检查间隔
+	closeSig chan bool
+	done     chan bool
+}
+
+// membership 成员文件内容
+type membership struct {
+	ConnAddrs []string `json:"ConnAddrs" yaml:"ConnAddrs"`
+}
+
+// Start 实现 Discovery 接口
+func (d *FileDiscovery) Start(update func(addrs []string)) {
+	if d.Interval <= 0 {
+		d.Interval = time.Second
+		log.Release("invalid Interval, reset to %v", d.Interval)
+	}
+	d.closeSig = make(chan bool)
+	d.done = make(chan bool)
+
+	var last []byte
+	var lastErr string // 只在错误变化时打印日志，避免每次检查都打印
+	fail := func(format string, err error) {
+		if err.Error() != lastErr {
+			lastErr = err.Error()
+			log.Error(format, d.Path, err)
+		}
+	}
+	ok := func() {
+		if lastErr != "" {
+			lastErr = ""
+			log.Release("membership file %v is valid again", d.Path)
+		}
+	}
+	check := func() {
+		data, err := os.ReadFile(d.Path)
+		if err != nil {
+			fail("read membership file %v error: %v", err)
+			return
+		}
+		if last != nil && bytes.Equal(data, last) {
+			ok()
+			return
+		}
+
+		addrs, err := d.parse(data)
+		if err != nil {
+			// 文件可能正在被写入，保持当前成员不变
+			fail("parse membership file %v error: %v", err)
+			return
+		}
+		ok()
+		last = data
+		update(addrs)
+	}
+
+	check()
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(d.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-d.closeSig:
+				return
+			case <-ticker.C:
+				check()
+			}
+		}
+	}()
+}
+
+// parse 解析成员文件，返回排序去重后的地址列表
+func (d *FileDiscovery) parse(data []byte) ([]string, error) {
+	var m membership
+	var err error
+	switch strings.ToLower(filepath.Ext(d.Path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &m)
+	default:
+		err = json.Unmarshal(data, &m)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(m.ConnAddrs)
+	addrs := m.ConnAddrs[:0]
+	for i, addr := range m.ConnAddrs {
+		if addr == "" || i > 0 && addr == m.ConnAddrs[i-1] {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs, nil
+}
+
+// Stop 实现 Discovery 接口
+func (d *FileDiscovery) Stop() {
+	close(d.closeSig)
+	<-d.done
+}
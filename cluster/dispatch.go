@@ -0,0 +1,65 @@
+package cluster
+
+import (
+	"sync"
+)
+
+// dispatcher 按收到的顺序把消息交给本地模块（chanrpc.Server.Go、会话处理器）
+// 模块繁忙、调用队列满时只阻塞派发协程，读协程照常处理心跳和调用返回，
+// 连接不会因为心跳超时被断开；等待派发的消息数量没有上限
+type dispatcher struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	queue  []func()
+	closed bool
+	done   chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	d := new(dispatcher)
+	d.cond = sync.NewCond(&d.mutex)
+	d.done = make(chan struct{})
+	go d.run()
+	return d
+}
+
+// push 将 f 加入派发队列，不阻塞
+func (d *dispatcher) push(f func()) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.closed {
+		return
+	}
+	d.queue = append(d.queue, f)
+	d.cond.Signal()
+}
+
+func (d *dispatcher) run() {
+	defer close(d.done)
+
+	for {
+		d.mutex.Lock()
+		for len(d.queue) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.queue) == 0 {
+			d.mutex.Unlock()
+			return
+		}
+		f := d.queue[0]
+		d.queue[0] = nil
+		d.queue = d.queue[1:]
+		d.mutex.Unlock()
+
+		f()
+	}
+}
+
+// close 等待队列中的消息派发完毕
+func (d *dispatcher) close() {
+	d.mutex.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+	<-d.done
+}
@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/network"
+)
+
+// 目标模块繁忙时不需要返回的调用不阻塞读协程，心跳照常返回
+func TestBusyServer(t *testing.T) {
+	// 调用队列只有 1 个位置并且不被处理
+	s := chanrpc.NewServer(1)
+	s.Register("f", func(args []interface{}) {})
+	servers["busy"] = s
+	defer delete(servers, "busy")
+
+	server := &network.TCPServer{
+		Addr:            "127.0.0.1:13571",
+		MaxConnNum:      10,
+		PendingWriteNum: 10,
+		LenMsgLen:       4,
+		MaxMsgLen:       math.MaxUint32,
+		NewAgent:        newAgent,
+	}
+	server.Start()
+	// 关闭时等待已收到的调用派发完毕，开始处理调用直到服务端关闭
+	defer func() {
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-s.ChanCall:
+				case <-stop:
+					return
+				}
+			}
+		}()
+		server.Close()
+		close(stop)
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:13571")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	writeMessage(conn, &message{Type: msgHandshake, Name: "busy-test", Instance: "busy-test"})
+	for i := 0; i < 3; i++ {
+		writeMessage(conn, &message{Type: msgRequest, Server: "busy", ID: "f"})
+	}
+	writeMessage(conn, &message{Type: msgPing})
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		m, err := readMessage(conn)
+		if err != nil {
+			t.Fatalf("pong not received: %v", err)
+		}
+		if m.Type == msgPong {
+			break
+		}
+	}
+	if n := len(s.ChanCall); n != 1 {
+		t.Fatalf("%v calls queued, want 1", n)
+	}
+}
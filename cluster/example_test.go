@@ -0,0 +1,126 @@
+package cluster_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+)
+
+func Example() {
+	logger, _ := log.New("fatal", "", 0)
+	log.Export(logger)
+
+	// node 1
+	s := chanrpc.NewServer(10)
+	s.Register("add", func(args []interface{}) interface{} {
+		return args[0].(int) + args[1].(int)
+	})
+	s.Register("swap", func(args []interface{}) []interface{} {
+		return []interface{}{args[1], args[0]}
+	})
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	cluster.Register("game", s)
+
+	// node events
+	up := make(chan *cluster.Peer, 1)
+	w := chanrpc.NewServer(10)
+	w.Register("NodeUp", func(args []interface{}) {
+		up <- args[0].(*cluster.Peer)
+	})
+	w.Register("NodeDown", func(args []interface{}) {})
+	go func() {
+		for ci := range w.ChanCall {
+			w.Exec(ci)
+		}
+	}()
+	cluster.Watch(w)
+
+	// the node connects to itself
+	conf.NodeName = "game-1"
+	conf.NodeRole = "game"
+	conf.ListenAddr = "127.0.0.1:13564"
+	conf.ConnAddrs = []string{"127.0.0.1:13564"}
+	conf.PendingWriteNum = 100
+	conf.HeartbeatInterval = time.Second
+	conf.HeartbeatTimeout = 5 * time.Second
+	cluster.Init()
+	defer cluster.Destroy()
+
+	// node 2
+	p := <-up
+	fmt.Println(len(cluster.NodesByRole("game")), p.Name(), p.Role())
+
+	// sync
+	r, err := p.Call1("game", "add", 1, 2)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(r)
+	}
+
+	rn, err := p.CallN("game", "swap", "a", "b")
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Println(rn[0], rn[1])
+	}
+
+	_, err = p.Call1("login", "add", 1, 2)
+	fmt.Println(err)
+
+	// asyn
+	c := p.Open("game", 10)
+	c.AsynCall("add", 3, 4, func(ret interface{}, err error) {
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			fmt.Println(ret)
+		}
+	})
+	c.Cb(<-c.ChanAsynRet)
+
+	// Output:
+	// 1 game-1 game
+	// 3
+	// b a
+	// chanrpc server login not registered
+	// 7
+}
+
+func ExampleFileDiscovery() {
+	dir, err := os.MkdirTemp("", "cluster")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cluster.yaml")
+	os.WriteFile(path, []byte("ConnAddrs: [127.0.0.1:3565, 127.0.0.1:3564, 127.0.0.1:3565]"), 0644)
+
+	members := make(chan []string, 10)
+	d := &cluster.FileDiscovery{Path: path, Interval: 10 * time.Millisecond}
+	d.Start(func(addrs []string) {
+		members <- addrs
+	})
+	fmt.Println(<-members)
+
+	os.WriteFile(path, []byte("ConnAddrs: [127.0.0.1:3566]"), 0644)
+	fmt.Println(<-members)
+
+	d.Stop()
+
+	// Output:
+	// [127.0.0.1:3564 127.0.0.1:3565]
+	// [127.0.0.1:3566]
+}
@@ -0,0 +1,116 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/network"
+)
+
+// writeMessage 按集群消息格式发送 m
+func writeMessage(conn net.Conn, m *message) error {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(m)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 4+buf.Len())
+	binary.BigEndian.PutUint32(b, uint32(buf.Len()))
+	copy(b[4:], buf.Bytes())
+	_, err = conn.Write(b)
+	return err
+}
+
+// readMessage 按集群消息格式读取一条消息
+func readMessage(conn net.Conn) (*message, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint32(n[:]))
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	m := new(message)
+	err := gob.NewDecoder(bytes.NewReader(b)).Decode(m)
+	return m, err
+}
+
+// 一直发送心跳的节点保持连接，不发送任何消息的节点在超时后被断开
+func TestHeartbeat(t *testing.T) {
+	const interval, timeout = 50 * time.Millisecond, 200 * time.Millisecond
+	// 连接的 Agent 读取心跳配置，服务端关闭后才能恢复
+	oldInterval, oldTimeout := conf.HeartbeatInterval, conf.HeartbeatTimeout
+	defer func() {
+		conf.HeartbeatInterval, conf.HeartbeatTimeout = oldInterval, oldTimeout
+	}()
+	conf.HeartbeatInterval, conf.HeartbeatTimeout = interval, timeout
+
+	server := &network.TCPServer{
+		Addr:            "127.0.0.1:13569",
+		MaxConnNum:      10,
+		PendingWriteNum: 10,
+		LenMsgLen:       4,
+		MaxMsgLen:       math.MaxUint32,
+		NewAgent:        newAgent,
+	}
+	server.Start()
+	defer server.Close()
+
+	dial := func() (net.Conn, chan struct{}) {
+		conn, err := net.Dial("tcp", "127.0.0.1:13569")
+		if err != nil {
+			t.Fatal(err)
+		}
+		closed := make(chan struct{})
+		go func() {
+			io.Copy(io.Discard, conn)
+			close(closed)
+		}()
+		return conn, closed
+	}
+
+	start := time.Now()
+	dead, deadClosed := dial()
+	defer dead.Close()
+	alive, aliveClosed := dial()
+	defer alive.Close()
+	stop := make(chan struct{})
+	pinged := make(chan struct{})
+	go func() {
+		defer close(pinged)
+		for writeMessage(alive, &message{Type: msgPing}) == nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-pinged
+	}()
+
+	select {
+	case <-deadClosed:
+		if elapsed := time.Since(start); elapsed < timeout {
+			t.Fatalf("dead node closed after %v, timeout %v", elapsed, timeout)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("dead node not closed")
+	}
+
+	select {
+	case <-aliveClosed:
+		t.Fatal("alive node closed")
+	case <-time.After(3 * timeout):
+	}
+}
@@ -0,0 +1,192 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+)
+
+var (
+	mutexPeers sync.Mutex               // 保护 peers 以及 Peer 的连接列表
+	peers      = make(map[string]*Peer) // 节点名字 -> 节点
+	watchers   []*chanrpc.Server        // 接收节点上下线通知的 chanrpc.Server
+	instance   = newInstance()          // 本进程的实例 id，用于区分同名的不同节点
+)
+
+// Watch 注册接收节点上下线通知的 chanrpc.Server
+// 节点第一条连接建立时调用 "NodeUp"，最后一条连接断开时调用 "NodeDown"，参数为 *Peer
+// 必须在 cluster.Init 之前调用，非线程安全
+func Watch(s *chanrpc.Server) {
+	watchers = append(watchers, s)
+}
+
+// notify 向所有 watcher 发送节点事件
+func notify(id string, p *Peer) {
+	for _, s := range watchers {
+		s.Go(id, p)
+	}
+}
+
+// Peer 表示集群中的一个节点，通过握手得到的名字寻址
+// 同一个节点断线重连后使用同一个 Peer，因此 Peer 可以长期持有
+type Peer struct {
+	name     string   // 节点名字
+	role     string   // 节点角色
+	instance string   // 节点进程的实例 id，节点重启后改变
+	agents   []*Agent // 与该节点之间的连接，双方互相连接时可能有多条
+}
+
+// Name 返回节点名字
+func (p *Peer) Name() string {
+	return p.name
+}
+
+// Role 返回节点角色
+func (p *Peer) Role() string {
+	mutexPeers.Lock()
+	defer mutexPeers.Unlock()
+	return p.role
+}
+
+// Connected 判断节点当前是否已连接
+func (p *Peer) Connected() bool {
+	return p.agent() != nil
+}
+
+// agent 返回与节点通信使用的连接，未连接时返回 nil
+func (p *Peer) agent() *Agent {
+	mutexPeers.Lock()
+	defer mutexPeers.Unlock()
+	if len(p.agents) == 0 {
+		return nil
+	}
+	return p.agents[0]
+}
+
+// Node 返回名字为 name 的已连接节点，未连接时返回 nil
+func Node(name string) *Peer {
+	mutexPeers.Lock()
+	defer mutexPeers.Unlock()
+	p := peers[name]
+	if p == nil || len(p.agents) == 0 {
+		return nil
+	}
+	return p
+}
+
+// NodesByRole 返回角色为 role 的所有已连接节点，按名字排序
+func NodesByRole(role string) []*Peer {
+	mutexPeers.Lock()
+	defer mutexPeers.Unlock()
+
+	var ps []*Peer
+	for _, p := range peers {
+		if p.role == role && len(p.agents) > 0 {
+			ps = append(ps, p)
+		}
+	}
+	sort.Slice(ps, func(i, j int) bool {
+		return ps[i].name < ps[j].name
+	})
+	return ps
+}
+
+// newInstance 生成随机的实例 id
+func newInstance() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// localName 返回握手时发送的本节点名字
+func localName() string {
+	if conf.NodeName != "" {
+		return conf.NodeName
+	}
+	if conf.ListenAddr != "" {
+		return conf.ListenAddr
+	}
+	// 只主动连接的节点没有监听地址，使用主机名和进程 id，重连时名字不变
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v-%v", host, os.Getpid())
+}
+
+// handleHandshake 处理对端发来的握手，将连接加入对应节点
+func (a *Agent) handleHandshake(m *message) {
+	if m.Name == "" {
+		log.Error("invalid node name from %v", a.conn.RemoteAddr())
+		a.conn.Close()
+		return
+	}
+
+	mutexPeers.Lock()
+	if a.peer != nil {
+		mutexPeers.Unlock()
+		log.Error("node %v handshake again", a.peer.name)
+		return
+	}
+	p := peers[m.Name]
+	if p == nil {
+		p = new(Peer)
+		p.name = m.Name
+		peers[m.Name] = p
+	}
+	if len(p.agents) > 0 && p.instance != m.Instance {
+		// 已连接的节点与新连接的实例不同，说明有两个节点使用了同一个名字
+		mutexPeers.Unlock()
+		log.Error("duplicate node name %v from %v", m.Name, a.conn.RemoteAddr())
+		a.conn.Close()
+		return
+	}
+	p.role = m.Role
+	p.instance = m.Instance
+	p.agents = append(p.agents, a)
+	up := len(p.agents) == 1
+	a.peer = p
+	mutexPeers.Unlock()
+
+	log.Release("node %v (%v) connected from %v", p.name, m.Role, a.conn.RemoteAddr())
+	if up {
+		a.dispatch.push(func() { notify("NodeUp", p) })
+	}
+}
+
+// handshaked 判断连接是否已完成握手
+func (a *Agent) handshaked() bool {
+	mutexPeers.Lock()
+	defer mutexPeers.Unlock()
+	return a.peer != nil
+}
+
+// removeAgent 连接关闭时将其从所属节点移除
+func removeAgent(a *Agent) {
+	mutexPeers.Lock()
+	p := a.peer
+	if p == nil {
+		mutexPeers.Unlock()
+		return
+	}
+	for i, _a := range p.agents {
+		if _a == a {
+			p.agents = append(p.agents[:i], p.agents[i+1:]...)
+			break
+		}
+	}
+	down := len(p.agents) == 0
+	mutexPeers.Unlock()
+
+	log.Release("node %v disconnected from %v", p.name, a.conn.RemoteAddr())
+	if down {
+		notify("NodeDown", p)
+		sessionsDown(p)
+	}
+}
@@ -0,0 +1,424 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+)
+
+// 集群消息类型
+const (
+	msgHandshake    = iota // 握手，交换节点名字和角色
+	msgRequest             // 调用请求
+	msgResponse            // 调用返回
+	msgPing                // 心跳请求
+	msgPong                // 心跳返回
+	msgSessionOpen         // 前端打开会话
+	msgSessionData         // 前端转发会话消息
+	msgSessionClose        // 前端关闭会话
+	msgSessionReply        // 后端返回会话消息
+	msgSessionKick         // 后端关闭会话
+)
+
+// message 表示节点之间传输的一条消息，使用 gob 编码
+// 函数 id、参数和返回值必须能被 gob 编码，自定义类型需要先调用 gob.Register 注册
+type message struct {
+	Type     uint8         // 消息类型
+	Name     string        // 握手时的节点名字
+	Role     string        // 握手时的节点角色
+	Instance string        // 握手时的节点实例 id
+	Seq      uint32        // 请求序号，0 表示不需要返回
+	Server   string        // 目标 chanrpc.Server 的名字
+	ID       interface{}   // 函数 id
+	N        int           // 返回值类型 0/1/2
+	Args     []interface{} // 参数
+	Ret      interface{}   // 单返回值
+	Rets     []interface{} // 多返回值
+	Err      string        // 错误信息
+
+	Session uint64 // 会话 id
+	Addr    string // 会话客户端地址
+	Data    []byte // 会话消息
+}
+
+// servers 保存暴露给其他节点的 chanrpc.Server
+var servers = make(map[string]*chanrpc.Server)
+
+// Register 将本地的 chanrpc.Server 以 name 暴露给其他节点调用
+// 必须在 cluster.Init 之前调用，非线程安全
+func Register(name string, s *chanrpc.Server) {
+	if _, ok := servers[name]; ok {
+		log.Fatal("chanrpc server %v is already registered", name)
+	}
+
+	servers[name] = s
+}
+
+// handleRequest 处理其他节点发来的调用请求
+func (a *Agent) handleRequest(m *message) {
+	s := servers[m.Server]
+	if s == nil {
+		a.reply(m.Seq, &message{Err: fmt.Sprintf("chanrpc server %v not registered", m.Server)})
+		return
+	}
+
+	// 不需要返回，目标模块的调用队列满时 Go 会阻塞，交给派发协程
+	if m.Seq == 0 {
+		a.dispatch.push(func() { s.Go(m.ID, m.Args...) })
+		return
+	}
+
+	// 同步调用会阻塞直到目标模块执行完毕，不能占用读协程，同时执行的数量有上限
+	if a.requests != nil {
+		select {
+		case a.requests <- struct{}{}:
+		default:
+			a.reply(m.Seq, &message{Err: "too many calls"})
+			return
+		}
+	}
+	go func() {
+		if a.requests != nil {
+			defer func() { <-a.requests }()
+		}
+
+		r := new(message)
+		var err error
+		switch m.N {
+		case 0:
+			err = s.Call0(m.ID, m.Args...)
+		case 1:
+			r.Ret, err = s.Call1(m.ID, m.Args...)
+		case 2:
+			r.Rets, err = s.CallN(m.ID, m.Args...)
+		default:
+			err = fmt.Errorf("invalid return type %v", m.N)
+		}
+		if err != nil {
+			r.Err = err.Error()
+		}
+		a.reply(m.Seq, r)
+	}()
+}
+
+// reply 发送调用结果
+func (a *Agent) reply(seq uint32, r *message) {
+	if seq == 0 {
+		return
+	}
+
+	r.Type = msgResponse
+	r.Seq = seq
+	err := a.writeMsg(r)
+	if err != nil {
+		// 返回值无法编码时也要让调用方结束等待
+		log.Error("write response error: %v", err)
+		a.writeMsg(&message{Type: msgResponse, Seq: seq, Err: err.Error()})
+	}
+}
+
+// handleResponse 处理其他节点返回的调用结果
+func (a *Agent) handleResponse(m *message) {
+	a.Lock()
+	c := a.pending[m.Seq]
+	delete(a.pending, m.Seq)
+	a.Unlock()
+	if c == nil {
+		return
+	}
+
+	ri := &RetInfo{cb: c.cb}
+	if m.Err != "" {
+		ri.err = errors.New(m.Err)
+	}
+	switch c.n {
+	case 1:
+		ri.ret = m.Ret
+	case 2:
+		ri.ret = m.Rets
+	}
+	c.chanRet <- ri
+}
+
+// call 向其他节点发送调用请求，chanRet 为 nil 时不需要返回
+func (a *Agent) call(server string, id interface{}, args []interface{}, n int, chanRet chan *RetInfo, cb interface{}) error {
+	m := &message{
+		Type:   msgRequest,
+		Server: server,
+		ID:     id,
+		N:      n,
+		Args:   args,
+	}
+
+	if chanRet != nil {
+		a.Lock()
+		if a.closeFlag {
+			a.Unlock()
+			return errors.New("cluster agent closed")
+		}
+		a.seq++
+		if a.seq == 0 {
+			a.seq++
+		}
+		m.Seq = a.seq
+		// 先登记再发送，否则返回可能先于登记到达
+		c := &pendingCall{n: n, chanRet: chanRet, cb: cb}
+		if conf.ClusterCallTimeout > 0 {
+			c.deadline = time.Now().Add(conf.ClusterCallTimeout)
+		}
+		a.pending[m.Seq] = c
+		a.Unlock()
+	}
+
+	err := a.writeMsg(m)
+	if err != nil && chanRet != nil {
+		a.Lock()
+		_, ok := a.pending[m.Seq]
+		delete(a.pending, m.Seq)
+		a.Unlock()
+		if !ok {
+			// 连接关闭或超时已经向 chanRet 发送了返回，不能再返回错误
+			return nil
+		}
+	}
+	return err
+}
+
+// checkTimeout 定时结束超时的调用，避免对端不返回时调用方一直等待
+func (a *Agent) checkTimeout() {
+	interval := time.Second
+	if conf.ClusterCallTimeout < interval {
+		interval = conf.ClusterCallTimeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.closeSig:
+			return
+		case now := <-ticker.C:
+			var expired []*pendingCall
+			a.Lock()
+			for seq, c := range a.pending {
+				if !c.deadline.IsZero() && now.After(c.deadline) {
+					expired = append(expired, c)
+					delete(a.pending, seq)
+				}
+			}
+			a.Unlock()
+
+			for _, c := range expired {
+				c.chanRet <- &RetInfo{err: errors.New("cluster call timeout"), cb: c.cb}
+			}
+		}
+	}
+}
+
+// Go 调用节点上名为 server 的 chanrpc.Server，不等待返回
+func (p *Peer) Go(server string, id interface{}, args ...interface{}) {
+	a := p.agent()
+	if a == nil {
+		log.Error("cluster go %v error: node %v not connected", id, p.name)
+		return
+	}
+
+	err := a.call(server, id, args, 0, nil, nil)
+	if err != nil {
+		log.Error("cluster go %v error: %v", id, err)
+	}
+}
+
+// Call0 同步调用节点上无返回值的函数
+func (p *Peer) Call0(server string, id interface{}, args ...interface{}) error {
+	return p.Open(server, 0).Call0(id, args...)
+}
+
+// Call1 同步调用节点上单返回值的函数
+func (p *Peer) Call1(server string, id interface{}, args ...interface{}) (interface{}, error) {
+	return p.Open(server, 0).Call1(id, args...)
+}
+
+// CallN 同步调用节点上多返回值的函数
+func (p *Peer) CallN(server string, id interface{}, args ...interface{}) ([]interface{}, error) {
+	return p.Open(server, 0).CallN(id, args...)
+}
+
+// Open 创建新的 Client 并绑定到节点上名为 server 的 chanrpc.Server
+func (p *Peer) Open(server string, l int) *Client {
+	c := NewClient(l)
+	c.Attach(p, server)
+	return c
+}
+
+// RetInfo 表示远程调用的返回信息
+type RetInfo struct {
+	ret interface{} // 返回值，可以是 nil / interface{} / []interface{}
+	err error       // 错误
+	cb  interface{} // 回调函数
+}
+
+// Client 表示远程 RPC 客户端，用法与 chanrpc.Client 相同
+// 每个 goroutine 对应一个 Client（非线程安全）
+type Client struct {
+	p               *Peer         // 绑定的节点
+	server          string        // 绑定的远程 chanrpc.Server 名字
+	chanSyncRet     chan *RetInfo // 同步返回通道
+	ChanAsynRet     chan *RetInfo // 异步返回通道
+	pendingAsynCall int           // 待处理异步调用数量
+}
+
+// NewClient 创建新的 Client
+func NewClient(l int) *Client {
+	c := new(Client)
+	c.chanSyncRet = make(chan *RetInfo, 1)
+	c.ChanAsynRet = make(chan *RetInfo, l)
+	return c
+}
+
+// Attach 绑定 Client 到节点上名为 server 的 chanrpc.Server
+// 节点断线重连后 Client 仍然有效
+func (c *Client) Attach(p *Peer, server string) {
+	c.p = p
+	c.server = server
+}
+
+// agent 返回调用使用的连接
+func (c *Client) agent() (*Agent, error) {
+	if c.p == nil {
+		return nil, errors.New("node not attached")
+	}
+	a := c.p.agent()
+	if a == nil {
+		return nil, fmt.Errorf("node %v not connected", c.p.name)
+	}
+	return a, nil
+}
+
+// syncCall 发送同步调用并等待返回
+func (c *Client) syncCall(id interface{}, args []interface{}, n int) (interface{}, error) {
+	a, err := c.agent()
+	if err != nil {
+		return nil, err
+	}
+
+	err = a.call(c.server, id, args, n, c.chanSyncRet, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	ri := <-c.chanSyncRet
+	return ri.ret, ri.err
+}
+
+// Call0 同步调用无返回值
+func (c *Client) Call0(id interface{}, args ...interface{}) error {
+	_, err := c.syncCall(id, args, 0)
+	return err
+}
+
+// Call1 同步调用单返回值
+func (c *Client) Call1(id interface{}, args ...interface{}) (interface{}, error) {
+	return c.syncCall(id, args, 1)
+}
+
+// CallN 同步调用多返回值
+func (c *Client) CallN(id interface{}, args ...interface{}) ([]interface{}, error) {
+	ret, err := c.syncCall(id, args, 2)
+	return assert(ret), err
+}
+
+// AsynCall 异步调用函数，回调定义与 chanrpc.Client.AsynCall 相同
+func (c *Client) AsynCall(id interface{}, _args ...interface{}) {
+	if len(_args) < 1 {
+		panic("callback function not found")
+	}
+
+	args := _args[:len(_args)-1] // 参数
+	cb := _args[len(_args)-1]    // 回调
+
+	var n int
+	switch cb.(type) {
+	case func(error):
+		n = 0
+	case func(interface{}, error):
+		n = 1
+	case func([]interface{}, error):
+		n = 2
+	default:
+		panic("definition of callback function is invalid")
+	}
+
+	// 异步调用过多
+	if c.pendingAsynCall >= cap(c.ChanAsynRet) {
+		execCb(&RetInfo{err: errors.New("too many calls"), cb: cb})
+		return
+	}
+
+	a, err := c.agent()
+	if err == nil {
+		err = a.call(c.server, id, args, n, c.ChanAsynRet, cb)
+	}
+	if err != nil {
+		c.ChanAsynRet <- &RetInfo{err: err, cb: cb}
+	}
+	c.pendingAsynCall++
+}
+
+// assert 将 interface{} 转为 []interface{}
+func assert(i interface{}) []interface{} {
+	if i == nil {
+		return nil
+	} else {
+		return i.([]interface{})
+	}
+}
+
+// execCb 执行回调
+func execCb(ri *RetInfo) {
+	defer func() {
+		if r := recover(); r != nil {
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				log.Error("%v: %s", r, buf[:l])
+			} else {
+				log.Error("%v", r)
+			}
+		}
+	}()
+
+	switch ri.cb.(type) {
+	case func(error):
+		ri.cb.(func(error))(ri.err)
+	case func(interface{}, error):
+		ri.cb.(func(interface{}, error))(ri.ret, ri.err)
+	case func([]interface{}, error):
+		ri.cb.(func([]interface{}, error))(assert(ri.ret), ri.err)
+	default:
+		panic("bug")
+	}
+}
+
+// Cb 处理异步返回
+func (c *Client) Cb(ri *RetInfo) {
+	c.pendingAsynCall--
+	execCb(ri)
+}
+
+// Close 关闭 Client，等待所有异步调用完成
+func (c *Client) Close() {
+	for c.pendingAsynCall > 0 {
+		c.Cb(<-c.ChanAsynRet)
+	}
+}
+
+// Idle 判断 Client 是否空闲
+func (c *Client) Idle() bool {
+	return c.pendingAsynCall == 0
+}
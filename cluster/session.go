@@ -0,0 +1,136 @@
+package cluster
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/name5566/leaf/log"
+)
+
+// SessionHandler 处理其他节点转发来的会话消息
+// 会话由前端节点（gate）创建，消息在前端和后端节点之间双向转发
+type SessionHandler interface {
+	OnSessionOpen(p *Peer, id uint64, remoteAddr string) // 前端打开会话，只有后端会收到
+	OnSessionData(p *Peer, id uint64, data []byte)       // 会话消息
+	OnSessionClose(p *Peer, id uint64)                   // 会话关闭
+	OnNodeDown(p *Peer)                                  // 节点断开，该节点上的会话全部失效
+}
+
+var (
+	mutexHandlers   sync.Mutex
+	backendHandler  SessionHandler // 处理前端转发来的会话
+	frontendHandler SessionHandler // 处理后端返回的会话消息
+)
+
+// SetBackendHandler 设置后端节点处理会话的 SessionHandler
+func SetBackendHandler(h SessionHandler) {
+	mutexHandlers.Lock()
+	defer mutexHandlers.Unlock()
+	backendHandler = h
+}
+
+// SetFrontendHandler 设置前端节点处理后端返回消息的 SessionHandler
+func SetFrontendHandler(h SessionHandler) {
+	mutexHandlers.Lock()
+	defer mutexHandlers.Unlock()
+	frontendHandler = h
+}
+
+// handlers 返回当前的会话处理器
+func handlers() (backend SessionHandler, frontend SessionHandler) {
+	mutexHandlers.Lock()
+	defer mutexHandlers.Unlock()
+	return backendHandler, frontendHandler
+}
+
+// NodeByHash 按 key 在角色为 role 的已连接节点中选择一个，没有可用节点时返回 nil
+// 节点列表不变时同一个 key 总是选中同一个节点
+func NodeByHash(role string, key uint64) *Peer {
+	ps := NodesByRole(role)
+	if len(ps) == 0 {
+		return nil
+	}
+	return ps[key%uint64(len(ps))]
+}
+
+// sendSession 向节点发送会话消息
+func (p *Peer) sendSession(m *message) error {
+	a := p.agent()
+	if a == nil {
+		return fmt.Errorf("node %v not connected", p.name)
+	}
+	return a.writeMsg(m)
+}
+
+// OpenSession 前端通知后端节点打开会话
+func (p *Peer) OpenSession(id uint64, remoteAddr string) error {
+	return p.sendSession(&message{Type: msgSessionOpen, Session: id, Addr: remoteAddr})
+}
+
+// ForwardSession 前端将会话消息转发到后端节点
+func (p *Peer) ForwardSession(id uint64, data []byte) error {
+	return p.sendSession(&message{Type: msgSessionData, Session: id, Data: data})
+}
+
+// CloseSession 前端通知后端节点会话已关闭
+func (p *Peer) CloseSession(id uint64) error {
+	return p.sendSession(&message{Type: msgSessionClose, Session: id})
+}
+
+// ReplySession 后端将会话消息发回前端节点
+func (p *Peer) ReplySession(id uint64, data []byte) error {
+	return p.sendSession(&message{Type: msgSessionReply, Session: id, Data: data})
+}
+
+// KickSession 后端要求前端节点关闭会话
+func (p *Peer) KickSession(id uint64) error {
+	return p.sendSession(&message{Type: msgSessionKick, Session: id})
+}
+
+// handleSession 处理会话消息
+func (a *Agent) handleSession(m *message) {
+	p := a.peer
+	if p == nil {
+		log.Error("session message before handshake from %v", a.conn.RemoteAddr())
+		return
+	}
+
+	backend, frontend := handlers()
+	switch m.Type {
+	case msgSessionOpen, msgSessionData, msgSessionClose:
+		if backend == nil {
+			log.Error("session message from node %v: backend handler not set", p.name)
+			return
+		}
+		switch m.Type {
+		case msgSessionOpen:
+			backend.OnSessionOpen(p, m.Session, m.Addr)
+		case msgSessionData:
+			backend.OnSessionData(p, m.Session, m.Data)
+		case msgSessionClose:
+			backend.OnSessionClose(p, m.Session)
+		}
+	case msgSessionReply, msgSessionKick:
+		if frontend == nil {
+			log.Error("session message from node %v: frontend handler not set", p.name)
+			return
+		}
+		switch m.Type {
+		case msgSessionReply:
+			frontend.OnSessionData(p, m.Session, m.Data)
+		case msgSessionKick:
+			frontend.OnSessionClose(p, m.Session)
+		}
+	}
+}
+
+// sessionsDown 节点断开时通知会话处理器
+func sessionsDown(p *Peer) {
+	backend, frontend := handlers()
+	if backend != nil {
+		backend.OnNodeDown(p)
+	}
+	if frontend != nil {
+		frontend.OnNodeDown(p)
+	}
+}
@@ -1,5 +1,7 @@
 package conf
 
+import "time"
+
 var (
 	LenStackBuf = 4096 // 栈缓冲区大小，用于捕获 panic 时的 stack 信息
 
@@ -10,11 +12,28 @@ var (
 
 	// console 配置
 	ConsolePort   int               // 控制台监听端口
+	ConsoleAddr   string            // 控制台监听地址，优先于 ConsolePort，例如 "unix:/var/run/leaf.sock"
 	ConsolePrompt string = "Leaf# " // 控制台提示符
 	ProfilePath   string            // 性能分析文件路径
 
 	// cluster 配置
+	NodeName        string   // 当前节点名字，例如 "battle-1"，为空时使用 ListenAddr
+	NodeRole        string   // 当前节点角色，例如 "battle"
 	ListenAddr      string   // 当前服务监听地址，用于集群通信
 	ConnAddrs       []string // 要连接的其他集群节点地址列表
+	ClusterFile     string   // 集群成员文件路径，文件中的节点地址变化时自动连接或断开
 	PendingWriteNum int      // 待写消息缓冲队列长度
+
+	ClusterCallTimeout time.Duration = 10 * time.Second // 跨节点调用等待返回的超时时间，超时后返回错误，0 表示不超时
+	ClusterMaxRequests int           = 1000             // 每条集群连接同时执行的同步调用上限，超过时直接返回错误
+
+	// 心跳默认开启，半开的连接（对端宕机、断网）在 HeartbeatTimeout 后断开并通知 NodeDown
+	HeartbeatInterval time.Duration = 10 * time.Second // 集群心跳间隔，0 表示不发送心跳
+	HeartbeatTimeout  time.Duration = 30 * time.Second // 超过该时间未收到节点的任何消息则断开连接，0 表示不检测，必须大于 HeartbeatInterval
+
+	// 集群 TLS 配置，设置了任一项时集群连接使用 TLS，配置不完整时启动失败
+	ClusterCertFile   string // 本节点证书，同时用于监听和主动连接，监听时必须设置
+	ClusterKeyFile    string // 本节点证书私钥
+	ClusterCAFile     string // 用于验证对端证书的 CA，设置后双向验证
+	ClusterServerName string // 主动连接时验证的服务端证书名字，为空时使用连接地址的主机名
 )
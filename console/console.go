@@ -14,15 +14,20 @@ var server *network.TCPServer // 控制台 TCP 服务器实例
 
 // Init 初始化控制台服务
 func Init() {
-	if conf.ConsolePort == 0 { // 如果未配置端口则不启动控制台
+	addr := conf.ConsoleAddr
+	if addr == "" && conf.ConsolePort != 0 {
+		addr = "localhost:" + strconv.Itoa(conf.ConsolePort)
+	}
+	if addr == "" { // 如果未配置地址和端口则不启动控制台
 		return
 	}
 
-	server = new(network.TCPServer)                             // 创建 TCPServer 实例
-	server.Addr = "localhost:" + strconv.Itoa(conf.ConsolePort) // 设置监听地址
-	server.MaxConnNum = int(math.MaxInt32)                      // 最大连接数
-	server.PendingWriteNum = 100                                // 待写消息缓冲长度
-	server.NewAgent = newAgent                                  // 设置新连接回调
+	server = new(network.TCPServer)        // 创建 TCPServer 实例
+	server.Addr = addr                     // 设置监听地址，unix: 开头时监听 unix domain socket
+	server.UnixMode = 0600                 // 只允许启动进程的用户连接
+	server.MaxConnNum = int(math.MaxInt32) // 最大连接数
+	server.PendingWriteNum = 100           // 待写消息缓冲长度
+	server.NewAgent = newAgent             // 设置新连接回调
 
 	server.Start() // 启动服务器
 }
@@ -4,8 +4,12 @@ import (
 	"net"
 )
 
+// the agents are network.Repliers, the replies of network.HandleRequest go
+// through Reply
 type Agent interface {
 	WriteMsg(msg interface{})
+	// replies to the request of id, msg may be an error, id zero writes msg as is
+	Reply(id uint32, msg interface{})
 	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
 	Close()
@@ -13,3 +17,8 @@ type Agent interface {
 	UserData() interface{}
 	SetUserData(data interface{})
 }
+
+var (
+	_ Agent = (*agent)(nil)
+	_ Agent = (*remoteAgent)(nil)
+)
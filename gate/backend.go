@@ -0,0 +1,220 @@
+package gate
+
+import (
+	"net"
+	"reflect"
+	"sync"
+
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
+)
+
+// Backend serves the agents forwarded by gates on other nodes,
+// the agents behave the same as the ones of a local Gate, Processor is
+// required for the forwarded data
+type Backend struct {
+	Processor    network.Processor
+	AgentChanRPC *chanrpc.Server
+
+	mutexAgents sync.Mutex
+	agents      map[sessionKey]*remoteAgent
+}
+
+type sessionKey struct {
+	peer *cluster.Peer
+	id   uint64
+}
+
+func (b *Backend) Run(closeSig chan bool) {
+	if b.Processor == nil {
+		log.Fatal("Backend Processor must not be nil")
+	}
+
+	b.mutexAgents.Lock()
+	b.agents = make(map[sessionKey]*remoteAgent)
+	b.mutexAgents.Unlock()
+
+	cluster.SetBackendHandler(b)
+	<-closeSig
+	cluster.SetBackendHandler(nil)
+
+	b.mutexAgents.Lock()
+	agents := b.agents
+	b.agents = nil
+	b.mutexAgents.Unlock()
+
+	for _, a := range agents {
+		a.onClose()
+	}
+}
+
+func (b *Backend) OnDestroy() {}
+
+func (b *Backend) OnSessionOpen(p *cluster.Peer, id uint64, remoteAddr string) {
+	a := &remoteAgent{
+		backend:    b,
+		peer:       p,
+		id:         id,
+		remoteAddr: sessionAddr(remoteAddr),
+	}
+
+	b.mutexAgents.Lock()
+	if b.agents == nil {
+		b.mutexAgents.Unlock()
+		p.KickSession(id)
+		return
+	}
+	key := sessionKey{p, id}
+	old := b.agents[key]
+	b.agents[key] = a
+	b.mutexAgents.Unlock()
+
+	if old != nil {
+		// the close of the session was lost, the old agent is gone
+		log.Debug("session %v of node %v opened again", id, p.Name())
+		old.onClose()
+	}
+	if b.AgentChanRPC != nil {
+		b.AgentChanRPC.Go("NewAgent", a)
+	}
+}
+
+func (b *Backend) OnSessionData(p *cluster.Peer, id uint64, data []byte) {
+	b.mutexAgents.Lock()
+	a := b.agents[sessionKey{p, id}]
+	b.mutexAgents.Unlock()
+	if a == nil {
+		log.Debug("session %v of node %v not found", id, p.Name())
+		return
+	}
+
+	msg, err := b.Processor.Unmarshal(data)
+	if err != nil {
+		log.Debug("unmarshal message error: %v", err)
+		a.Close()
+		return
+	}
+	err = b.Processor.Route(msg, a)
+	if err != nil {
+		log.Debug("route message error: %v", err)
+		a.Close()
+	}
+}
+
+func (b *Backend) OnSessionClose(p *cluster.Peer, id uint64) {
+	key := sessionKey{p, id}
+
+	b.mutexAgents.Lock()
+	a := b.agents[key]
+	delete(b.agents, key)
+	b.mutexAgents.Unlock()
+
+	if a != nil {
+		a.onClose()
+	}
+}
+
+func (b *Backend) OnNodeDown(p *cluster.Peer) {
+	b.mutexAgents.Lock()
+	var agents []*remoteAgent
+	for key, a := range b.agents {
+		if key.peer == p {
+			agents = append(agents, a)
+			delete(b.agents, key)
+		}
+	}
+	b.mutexAgents.Unlock()
+
+	for _, a := range agents {
+		a.onClose()
+	}
+}
+
+// sessionAddr is the address of a client connected to another node
+type sessionAddr string
+
+func (addr sessionAddr) Network() string {
+	return "cluster"
+}
+
+func (addr sessionAddr) String() string {
+	return string(addr)
+}
+
+// remoteAgent is an agent connected to a gate on another node
+type remoteAgent struct {
+	backend    *Backend
+	peer       *cluster.Peer
+	id         uint64
+	remoteAddr net.Addr
+	userData   interface{}
+}
+
+func (a *remoteAgent) onClose() {
+	if a.backend.AgentChanRPC != nil {
+		// don't block the cluster connection
+		a.backend.AgentChanRPC.Go("CloseAgent", a)
+	}
+}
+
+func (a *remoteAgent) WriteMsg(msg interface{}) {
+	if a.backend.Processor != nil {
+		data, err := a.backend.Processor.Marshal(msg)
+		if err != nil {
+			log.Error("marshal message %v error: %v", reflect.TypeOf(msg), err)
+			return
+		}
+
+		// merge the args
+		var msgLen int
+		for i := 0; i < len(data); i++ {
+			msgLen += len(data[i])
+		}
+		b := make([]byte, 0, msgLen)
+		for i := 0; i < len(data); i++ {
+			b = append(b, data[i]...)
+		}
+
+		err = a.peer.ReplySession(a.id, b)
+		if err != nil {
+			log.Error("write message %v error: %v", reflect.TypeOf(msg), err)
+		}
+	}
+}
+
+func (a *remoteAgent) Reply(id uint32, msg interface{}) {
+	if id == 0 {
+		a.WriteMsg(msg)
+		return
+	}
+	a.WriteMsg(&network.Request{ID: id, Msg: msg})
+}
+
+func (a *remoteAgent) LocalAddr() net.Addr {
+	return sessionAddr(a.peer.Name())
+}
+
+func (a *remoteAgent) RemoteAddr() net.Addr {
+	return a.remoteAddr
+}
+
+func (a *remoteAgent) Close() {
+	err := a.peer.KickSession(a.id)
+	if err != nil {
+		log.Debug("close session error: %v", err)
+	}
+}
+
+func (a *remoteAgent) Destroy() {
+	a.Close()
+}
+
+func (a *remoteAgent) UserData() interface{} {
+	return a.userData
+}
+
+func (a *remoteAgent) SetUserData(data interface{}) {
+	a.userData = data
+}
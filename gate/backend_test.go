@@ -0,0 +1,162 @@
+package gate
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/network/json"
+)
+
+// agentEvents records the calls of AgentChanRPC
+func agentEvents() (*chanrpc.Server, chan string) {
+	events := make(chan string, 10)
+	s := chanrpc.NewServer(10)
+	for _, id := range []string{"NewAgent", "CloseAgent"} {
+		id := id
+		s.Register(id, func(args []interface{}) {
+			events <- id + " " + args[0].(Agent).RemoteAddr().String()
+		})
+	}
+	go func() {
+		for ci := range s.ChanCall {
+			s.Exec(ci)
+		}
+	}()
+	return s, events
+}
+
+func expectEvent(t *testing.T, events chan string, want string) {
+	select {
+	case e := <-events:
+		if e != want {
+			t.Fatalf("event %q, want %q", e, want)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("no event %q", want)
+	}
+}
+
+func TestBackendForward(t *testing.T) {
+	up := make(chan *cluster.Peer, 2)
+	w := chanrpc.NewServer(10)
+	w.Register("NodeUp", func(args []interface{}) {
+		up <- args[0].(*cluster.Peer)
+	})
+	w.Register("NodeDown", func(args []interface{}) {})
+	go func() {
+		for ci := range w.ChanCall {
+			w.Exec(ci)
+		}
+	}()
+	cluster.Watch(w)
+
+	// the node is the frontend and the backend of itself
+	conf.NodeName = "backend-1"
+	conf.ListenAddr = "127.0.0.1:13567"
+	conf.ConnAddrs = []string{conf.ListenAddr}
+	conf.PendingWriteNum = 100
+	cluster.Init()
+	defer cluster.Destroy()
+
+	processor := json.NewProcessor()
+	processor.Register(&Hello{})
+	processor.SetHandler(&Hello{}, func(args []interface{}) {
+		args[1].(Agent).WriteMsg(&Hello{Name: "re " + args[0].(*Hello).Name})
+	})
+	agentRPC, events := agentEvents()
+	backend := &Backend{Processor: processor, AgentChanRPC: agentRPC}
+	backendClose := make(chan bool)
+	backendDone := make(chan struct{})
+	go func() {
+		backend.Run(backendClose)
+		close(backendDone)
+	}()
+	defer func() {
+		close(backendClose)
+		<-backendDone
+	}()
+	<-up
+
+	const addr = "127.0.0.1:13568"
+	gate := &Gate{
+		MaxConnNum:      10,
+		PendingWriteNum: 10,
+		MaxMsgLen:       4096,
+		TCPAddr:         addr,
+		LenMsgLen:       2,
+		SelectBackend: func(a Agent) *cluster.Peer {
+			return cluster.Node("backend-1")
+		},
+	}
+	closeSig := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		gate.Run(closeSig)
+		close(done)
+	}()
+	defer func() {
+		close(closeSig)
+		<-done
+	}()
+
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("tcp", addr); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is handled by the backend and the reply forwarded back
+	msg := []byte(`{"Hello":{"Name":"leaf"}}`)
+	conn.Write(append([]byte{0, byte(len(msg))}, msg...))
+	expectEvent(t, events, "NewAgent "+conn.LocalAddr().String())
+
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var n [2]byte
+	if _, err := io.ReadFull(conn, n[:]); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != `{"Hello":{"Name":"re leaf"}}` {
+		t.Fatalf("reply %s", reply)
+	}
+
+	// the session is closed with the client
+	local := conn.LocalAddr().String()
+	conn.Close()
+	expectEvent(t, events, "CloseAgent "+local)
+}
+
+// a session opened again closes the agent of the lost one
+func TestBackendSessionReopen(t *testing.T) {
+	agentRPC, events := agentEvents()
+	backend := &Backend{Processor: json.NewProcessor(), AgentChanRPC: agentRPC}
+	backend.agents = make(map[sessionKey]*remoteAgent)
+
+	p := new(cluster.Peer)
+	backend.OnSessionOpen(p, 1, "client-1")
+	backend.OnSessionOpen(p, 1, "client-2")
+	expectEvent(t, events, "NewAgent client-1")
+	expectEvent(t, events, "CloseAgent client-1")
+	expectEvent(t, events, "NewAgent client-2")
+
+	backend.OnNodeDown(p)
+	expectEvent(t, events, "CloseAgent client-2")
+	if len(backend.agents) != 0 {
+		t.Fatalf("%v agents left", len(backend.agents))
+	}
+}
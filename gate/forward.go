@@ -0,0 +1,114 @@
+package gate
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/name5566/leaf/cluster"
+	"github.com/name5566/leaf/log"
+)
+
+// frontend receives the messages returned by backend nodes
+type frontend struct {
+	sync.Mutex
+	agents map[uint64]*agent
+}
+
+var (
+	front     = &frontend{agents: make(map[uint64]*agent)}
+	lastID    uint64
+	frontOnce sync.Once
+)
+
+func nextSessionID() uint64 {
+	return atomic.AddUint64(&lastID, 1)
+}
+
+// get returns the agent of the session if it's bound to p
+func (f *frontend) get(p *cluster.Peer, id uint64) *agent {
+	f.Lock()
+	defer f.Unlock()
+	a := f.agents[id]
+	if a == nil || a.backend != p {
+		return nil
+	}
+	return a
+}
+
+func (f *frontend) OnSessionOpen(p *cluster.Peer, id uint64, remoteAddr string) {}
+
+func (f *frontend) OnSessionData(p *cluster.Peer, id uint64, data []byte) {
+	a := f.get(p, id)
+	if a == nil {
+		return
+	}
+	err := a.conn.WriteMsg(data)
+	if err != nil {
+		log.Error("write message from node %v error: %v", p.Name(), err)
+	}
+}
+
+func (f *frontend) OnSessionClose(p *cluster.Peer, id uint64) {
+	a := f.get(p, id)
+	if a == nil {
+		return
+	}
+	a.Close()
+}
+
+func (f *frontend) OnNodeDown(p *cluster.Peer) {
+	f.Lock()
+	var agents []*agent
+	for _, a := range f.agents {
+		if a.backend == p {
+			agents = append(agents, a)
+		}
+	}
+	f.Unlock()
+
+	for _, a := range agents {
+		a.Close()
+	}
+}
+
+// bind forwards all the following messages of the agent to p
+func (a *agent) bind(p *cluster.Peer) error {
+	front.Lock()
+	a.backend = p
+	front.agents[a.id] = a
+	front.Unlock()
+
+	return p.OpenSession(a.id, a.RemoteAddr().String())
+}
+
+func (a *agent) unbind() {
+	if a.backend == nil {
+		return
+	}
+
+	front.Lock()
+	delete(front.agents, a.id)
+	front.Unlock()
+
+	err := a.backend.CloseSession(a.id)
+	if err != nil {
+		log.Debug("close session error: %v", err)
+	}
+}
+
+// forward sends data to the backend node bound to the agent
+// returns false if the agent is not bound to any node
+func (a *agent) forward(data []byte) (bool, error) {
+	if a.backend == nil {
+		p := a.gate.SelectBackend(a)
+		if p == nil {
+			return false, nil
+		}
+		err := a.bind(p)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return true, a.backend.ForwardSession(a.id, data)
+}
@@ -1,11 +1,15 @@
 package gate
 
 import (
+	"fmt"
 	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/cluster"
 	"github.com/name5566/leaf/log"
 	"github.com/name5566/leaf/network"
 	"net"
+	"net/http"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -16,35 +20,152 @@ type Gate struct {
 	Processor       network.Processor
 	AgentChanRPC    *chanrpc.Server
 
+	// read timeout, zero means no timeout
+	FirstMsgTimeout time.Duration
+	IdleTimeout     time.Duration
+	// tcp keep-alive period, zero means the default, negative disables it
+	KeepAlive time.Duration
+
+	// write queue overflow, the conn is destroyed by default
+	// CoalesceKey gets the marshaled message, OnOverflow must not write to the conn
+	OverflowPolicy  network.OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceKey     func(args [][]byte) string
+	OnOverflow      func(network.Conn)
+
+	// compression
+	// tcp messages of CompressThreshold bytes or more are compressed, zero disables
+	// it, clients must do the same and a handshake on connect checks it, see
+	// network/compress.go; websocket uses permessage-deflate once
+	// EnableCompression is set and CompressThreshold is the min message len then
+	CompressThreshold int
+	EnableCompression bool
+
+	// connection limits of both servers, zero means no limit
+	// AllowCIDRs and DenyCIDRs take networks or single ips
+	MaxConnPerIP int
+	AcceptRate   float64 // new connections per second
+	AcceptBurst  int
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+
+	// inbound rate limits of an agent, zero means no limit
+	// MsgRates limits the messages of a type, the key is the type registered in
+	// the processor, such as reflect.TypeOf(&msg.Hello{}), messages forwarded to
+	// a backend are not unmarshaled and only limited by MsgRate and ByteRate;
+	// ByteBurst must not be less than MaxMsgLen for RateLimitDrop and RateLimitDisconnect
+	MsgRate         float64 // messages per second
+	MsgBurst        int
+	ByteRate        float64 // bytes per second
+	ByteBurst       int
+	MsgRates        map[reflect.Type]RateLimit
+	RateLimitAction RateLimitAction
+	// reports an offending agent, msgType is nil for MsgRate and ByteRate,
+	// called in the goroutine of the agent
+	OnRateLimit func(a Agent, msgType reflect.Type)
+
+	// resumable sessions, zero ResumeWindow disables them, see session.go
+	// a client reconnecting within ResumeWindow gets the same agent back and
+	// the missed messages, up to ResumeBuffer unacked ones are kept per agent;
+	// "ResumeAgent" is sent to AgentChanRPC once an agent is resumed
+	ResumeWindow time.Duration
+	ResumeBuffer int
+	sessions     sessionSet
+
+	// drain
+	// on close, "DrainAgent" is sent to AgentChanRPC for every live agent and
+	// the gate waits up to DrainTimeout for them to disconnect, the gate module
+	// should be registered after the modules that handle its agents
+	DrainTimeout time.Duration
+
 	// websocket
-	WSAddr      string
-	HTTPTimeout time.Duration
-	CertFile    string
-	KeyFile     string
+	WSAddr       string
+	HTTPTimeout  time.Duration
+	CertFile     string
+	KeyFile      string
+	PingInterval time.Duration
+	PongWait     time.Duration
+	Subprotocols []string
+	// the ip the connection limits apply to, see network.WSServer
+	ClientIP func(r *http.Request) string
+	// send text frames, the processors implementing network.TextProcessor,
+	// such as json, decide it themselves; always binary with resumable sessions
+	TextMessage bool
 
 	// tcp
 	TCPAddr      string
 	LenMsgLen    int
 	LittleEndian bool
+	// the len field of tcp messages, replaces LenMsgLen and LittleEndian if not nil
+	FrameCodec network.FrameCodec
+	// tls, TCPCAFile verifies client certificates (mutual tls)
+	TCPCertFile string
+	TCPKeyFile  string
+	TCPCAFile   string
+	// session encryption for clients unable to do tls, see network/cipher.go
+	Encrypt bool
+	// pool the read buffers, the data is copied for the handlers and the
+	// backends, a custom Processor must not keep the data given to Unmarshal
+	BufferPool bool
+
+	// reliable udp
+	UDPAddr string
+	// the conn is closed if the client sends nothing, pings included
+	UDPTimeout time.Duration
+
+	// backend
+	// messages of an agent are forwarded to the returned node once it's not nil,
+	// replies from the node are written back to the agent
+	SelectBackend func(a Agent) *cluster.Peer
 }
 
 func (gate *Gate) Run(closeSig chan bool) {
+	if gate.SelectBackend != nil {
+		frontOnce.Do(func() {
+			cluster.SetFrontendHandler(front)
+		})
+	}
+
+	if gate.ResumeWindow > 0 {
+		if gate.ResumeBuffer <= 0 {
+			gate.ResumeBuffer = 100
+		}
+		gate.openSessions()
+		defer gate.closeSessions()
+	}
+
 	var wsServer *network.WSServer
 	if gate.WSAddr != "" {
 		wsServer = new(network.WSServer)
 		wsServer.Addr = gate.WSAddr
 		wsServer.MaxConnNum = gate.MaxConnNum
+		wsServer.MaxConnPerIP = gate.MaxConnPerIP
+		wsServer.AcceptRate = gate.AcceptRate
+		wsServer.AcceptBurst = gate.AcceptBurst
+		wsServer.AllowCIDRs = gate.AllowCIDRs
+		wsServer.DenyCIDRs = gate.DenyCIDRs
+		wsServer.ClientIP = gate.ClientIP
 		wsServer.PendingWriteNum = gate.PendingWriteNum
+		wsServer.FirstMsgTimeout = gate.FirstMsgTimeout
+		wsServer.IdleTimeout = gate.IdleTimeout
+		wsServer.KeepAlive = gate.KeepAlive
+		wsServer.OverflowPolicy = gate.OverflowPolicy
+		wsServer.OverflowTimeout = gate.OverflowTimeout
+		wsServer.CoalesceKey = gate.CoalesceKey
+		wsServer.OnOverflow = gate.OnOverflow
 		wsServer.MaxMsgLen = gate.MaxMsgLen
 		wsServer.HTTPTimeout = gate.HTTPTimeout
 		wsServer.CertFile = gate.CertFile
 		wsServer.KeyFile = gate.KeyFile
+		wsServer.PingInterval = gate.PingInterval
+		wsServer.PongWait = gate.PongWait
+		wsServer.Subprotocols = gate.Subprotocols
+		wsServer.TextMessage = gate.textMessage()
+		wsServer.EnableCompression = gate.EnableCompression
+		wsServer.CompressThreshold = gate.CompressThreshold
+		wsServer.OnDrain = gate.drainAgent
 		wsServer.NewAgent = func(conn *network.WSConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn)
 		}
 	}
 
@@ -53,16 +174,52 @@ func (gate *Gate) Run(closeSig chan bool) {
 		tcpServer = new(network.TCPServer)
 		tcpServer.Addr = gate.TCPAddr
 		tcpServer.MaxConnNum = gate.MaxConnNum
+		tcpServer.MaxConnPerIP = gate.MaxConnPerIP
+		tcpServer.AcceptRate = gate.AcceptRate
+		tcpServer.AcceptBurst = gate.AcceptBurst
+		tcpServer.AllowCIDRs = gate.AllowCIDRs
+		tcpServer.DenyCIDRs = gate.DenyCIDRs
 		tcpServer.PendingWriteNum = gate.PendingWriteNum
+		tcpServer.FirstMsgTimeout = gate.FirstMsgTimeout
+		tcpServer.IdleTimeout = gate.IdleTimeout
+		tcpServer.KeepAlive = gate.KeepAlive
+		tcpServer.OverflowPolicy = gate.OverflowPolicy
+		tcpServer.OverflowTimeout = gate.OverflowTimeout
+		tcpServer.CoalesceKey = gate.CoalesceKey
+		tcpServer.OnOverflow = gate.OnOverflow
 		tcpServer.LenMsgLen = gate.LenMsgLen
 		tcpServer.MaxMsgLen = gate.MaxMsgLen
 		tcpServer.LittleEndian = gate.LittleEndian
+		tcpServer.BufferPool = gate.BufferPool
+		tcpServer.FrameCodec = gate.FrameCodec
+		tcpServer.CompressThreshold = gate.CompressThreshold
+		tcpServer.CertFile = gate.TCPCertFile
+		tcpServer.KeyFile = gate.TCPKeyFile
+		tcpServer.CAFile = gate.TCPCAFile
+		tcpServer.Encrypt = gate.Encrypt
+		tcpServer.OnDrain = gate.drainAgent
 		tcpServer.NewAgent = func(conn *network.TCPConn) network.Agent {
-			a := &agent{conn: conn, gate: gate}
-			if gate.AgentChanRPC != nil {
-				gate.AgentChanRPC.Go("NewAgent", a)
-			}
-			return a
+			return gate.newAgent(conn)
+		}
+	}
+
+	var udpServer *network.UDPServer
+	if gate.UDPAddr != "" {
+		udpServer = new(network.UDPServer)
+		udpServer.Addr = gate.UDPAddr
+		udpServer.MaxConnNum = gate.MaxConnNum
+		udpServer.PendingWriteNum = gate.PendingWriteNum
+		udpServer.MaxMsgLen = gate.MaxMsgLen
+		udpServer.FirstMsgTimeout = gate.FirstMsgTimeout
+		udpServer.IdleTimeout = gate.IdleTimeout
+		udpServer.Timeout = gate.UDPTimeout
+		udpServer.OverflowPolicy = gate.OverflowPolicy
+		udpServer.OverflowTimeout = gate.OverflowTimeout
+		udpServer.CoalesceKey = gate.CoalesceKey
+		udpServer.OnOverflow = gate.OnOverflow
+		udpServer.OnDrain = gate.drainAgent
+		udpServer.NewAgent = func(conn *network.UDPConn) network.Agent {
+			return gate.newAgent(conn)
 		}
 	}
 
@@ -72,13 +229,87 @@ func (gate *Gate) Run(closeSig chan bool) {
 	if tcpServer != nil {
 		tcpServer.Start()
 	}
+	if udpServer != nil {
+		udpServer.Start()
+	}
 	<-closeSig
+	if gate.DrainTimeout > 0 {
+		gate.drain(wsServer, tcpServer, udpServer)
+		return
+	}
 	if wsServer != nil {
 		wsServer.Close()
 	}
 	if tcpServer != nil {
 		tcpServer.Close()
 	}
+	if udpServer != nil {
+		udpServer.Close()
+	}
+}
+
+func (gate *Gate) textMessage() bool {
+	// the session headers are binary
+	if gate.ResumeWindow > 0 {
+		return false
+	}
+	if p, ok := gate.Processor.(network.TextProcessor); ok {
+		return p.TextMessage()
+	}
+	return gate.TextMessage
+}
+
+func (gate *Gate) drain(wsServer *network.WSServer, tcpServer *network.TCPServer, udpServer *network.UDPServer) {
+	var wg sync.WaitGroup
+	if wsServer != nil {
+		wg.Add(1)
+		go func() {
+			wsServer.Drain(gate.DrainTimeout)
+			wg.Done()
+		}()
+	}
+	if tcpServer != nil {
+		wg.Add(1)
+		go func() {
+			tcpServer.Drain(gate.DrainTimeout)
+			wg.Done()
+		}()
+	}
+	if udpServer != nil {
+		wg.Add(1)
+		go func() {
+			udpServer.Drain(gate.DrainTimeout)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+func (gate *Gate) newAgent(conn network.Conn) network.Agent {
+	if gate.ResumeWindow > 0 {
+		return &sessionAgent{gate: gate, conn: conn}
+	}
+
+	a := &agent{conn: conn, gate: gate, id: nextSessionID()}
+	if gate.AgentChanRPC != nil {
+		gate.AgentChanRPC.Go("NewAgent", a)
+	}
+	return a
+}
+
+func (gate *Gate) drainAgent(a network.Agent) {
+	if sa, ok := a.(*sessionAgent); ok {
+		gate.sessions.Lock()
+		agent := sa.agent
+		gate.sessions.Unlock()
+		if agent == nil {
+			return
+		}
+		a = agent
+	}
+	if gate.AgentChanRPC != nil {
+		gate.AgentChanRPC.Go("DrainAgent", a)
+	}
 }
 
 func (gate *Gate) OnDestroy() {}
@@ -87,9 +318,13 @@ type agent struct {
 	conn     network.Conn
 	gate     *Gate
 	userData interface{}
+	id       uint64
+	backend  *cluster.Peer
+	limiter  *agentLimiter
 }
 
 func (a *agent) Run() {
+	a.limiter = a.gate.newAgentLimiter()
 	for {
 		data, err := a.conn.ReadMsg()
 		if err != nil {
@@ -97,22 +332,52 @@ func (a *agent) Run() {
 			break
 		}
 
-		if a.gate.Processor != nil {
-			msg, err := a.gate.Processor.Unmarshal(data)
-			if err != nil {
-				log.Debug("unmarshal message error: %v", err)
-				break
-			}
-			err = a.gate.Processor.Route(msg, a)
-			if err != nil {
-				log.Debug("route message error: %v", err)
-				break
-			}
+		err = a.handle(data)
+		network.ReleaseMsg(a.conn, data)
+		if err != nil {
+			log.Debug("%v", err)
+			break
+		}
+	}
+}
+
+// data is released after handle returns
+func (a *agent) handle(data []byte) error {
+	ok, err := a.limitData(data)
+	if !ok {
+		return err
+	}
+
+	if a.gate.SelectBackend != nil {
+		forwarded, err := a.forward(data)
+		if err != nil {
+			return fmt.Errorf("forward message error: %v", err)
+		}
+		if forwarded {
+			return nil
+		}
+	}
+
+	if a.gate.Processor != nil {
+		msg, err := a.gate.Processor.Unmarshal(data)
+		if err != nil {
+			return fmt.Errorf("unmarshal message error: %v", err)
+		}
+		ok, err = a.limitMsg(msg)
+		if !ok {
+			return err
+		}
+		err = a.gate.Processor.Route(msg, a)
+		if err != nil {
+			return fmt.Errorf("route message error: %v", err)
 		}
 	}
+	return nil
 }
 
 func (a *agent) OnClose() {
+	a.unbind()
+
 	if a.gate.AgentChanRPC != nil {
 		err := a.gate.AgentChanRPC.Call0("CloseAgent", a)
 		if err != nil {
@@ -135,6 +400,14 @@ func (a *agent) WriteMsg(msg interface{}) {
 	}
 }
 
+func (a *agent) Reply(id uint32, msg interface{}) {
+	if id == 0 {
+		a.WriteMsg(msg)
+		return
+	}
+	a.WriteMsg(&network.Request{ID: id, Msg: msg})
+}
+
 func (a *agent) LocalAddr() net.Addr {
 	return a.conn.LocalAddr()
 }
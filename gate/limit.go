@@ -0,0 +1,130 @@
+package gate
+
+import (
+	"errors"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
+	"github.com/name5566/leaf/util"
+	"reflect"
+	"time"
+)
+
+// what to do when an agent sends messages too fast
+type RateLimitAction int
+
+const (
+	// drop the message
+	RateLimitDrop RateLimitAction = iota
+	// stop reading until the message is within the limit
+	RateLimitDelay
+	// close the agent
+	RateLimitDisconnect
+)
+
+// Burst is the max number of messages, or bytes, above Rate,
+// zero means one second of Rate
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+var errRateLimit = errors.New("rate limit exceeded")
+
+type agentLimiter struct {
+	msgs   *util.TokenBucket
+	bytes  *util.TokenBucket
+	byType map[reflect.Type]*util.TokenBucket
+}
+
+func newBucket(limit RateLimit) *util.TokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = int(limit.Rate + 0.5)
+	}
+	return util.NewTokenBucket(limit.Rate, burst)
+}
+
+// nil if the gate has no rate limits
+func (gate *Gate) newAgentLimiter() *agentLimiter {
+	if gate.MsgRate <= 0 && gate.ByteRate <= 0 && len(gate.MsgRates) == 0 {
+		return nil
+	}
+
+	l := new(agentLimiter)
+	l.msgs = newBucket(RateLimit{gate.MsgRate, gate.MsgBurst})
+	l.bytes = newBucket(RateLimit{gate.ByteRate, gate.ByteBurst})
+	if len(gate.MsgRates) > 0 {
+		l.byType = make(map[reflect.Type]*util.TokenBucket)
+		for t, limit := range gate.MsgRates {
+			if b := newBucket(limit); b != nil {
+				l.byType[t] = b
+			}
+		}
+	}
+	return l
+}
+
+// limitData checks the message and byte rates of data, false if it's dropped
+func (a *agent) limitData(data []byte) (bool, error) {
+	if a.limiter == nil {
+		return true, nil
+	}
+
+	ok, err := a.limit(a.limiter.msgs, 1, nil)
+	if !ok {
+		return ok, err
+	}
+	return a.limit(a.limiter.bytes, len(data), nil)
+}
+
+// limitMsg checks the rate of the unmarshaled msg, false if it's dropped
+func (a *agent) limitMsg(msg interface{}) (bool, error) {
+	if a.limiter == nil || a.limiter.byType == nil {
+		return true, nil
+	}
+
+	if req, ok := msg.(*network.Request); ok {
+		msg = req.Msg
+	}
+	msgType := reflect.TypeOf(msg)
+	return a.limit(a.limiter.byType[msgType], 1, msgType)
+}
+
+func (a *agent) limit(b *util.TokenBucket, n int, msgType reflect.Type) (bool, error) {
+	if b == nil {
+		return true, nil
+	}
+
+	now := time.Now()
+	if a.gate.RateLimitAction == RateLimitDelay {
+		d := b.Delay(now, n)
+		if d > 0 {
+			a.onRateLimit(msgType)
+			time.Sleep(d)
+		}
+		return true, nil
+	}
+
+	if b.AllowN(now, n) {
+		return true, nil
+	}
+	a.onRateLimit(msgType)
+	if a.gate.RateLimitAction == RateLimitDisconnect {
+		return false, errRateLimit
+	}
+	return false, nil
+}
+
+func (a *agent) onRateLimit(msgType reflect.Type) {
+	if msgType != nil {
+		log.Debug("agent %v exceeds the rate limit of %v", a.RemoteAddr(), msgType)
+	} else {
+		log.Debug("agent %v exceeds the rate limit", a.RemoteAddr())
+	}
+	if a.gate.OnRateLimit != nil {
+		a.gate.OnRateLimit(a, msgType)
+	}
+}
@@ -0,0 +1,114 @@
+package gate
+
+import (
+	"github.com/name5566/leaf/network/json"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// nopConn is a network.Conn reading nothing
+type nopConn struct{}
+
+func (nopConn) ReadMsg() ([]byte, error)      { return nil, nil }
+func (nopConn) WriteMsg(args ...[]byte) error { return nil }
+func (nopConn) LocalAddr() net.Addr           { return &net.TCPAddr{} }
+func (nopConn) RemoteAddr() net.Addr          { return &net.TCPAddr{} }
+func (nopConn) Close()                        {}
+func (nopConn) Destroy()                      {}
+
+func newLimitAgent(gate *Gate, limited *[]reflect.Type) *agent {
+	gate.OnRateLimit = func(a Agent, msgType reflect.Type) {
+		*limited = append(*limited, msgType)
+	}
+	a := &agent{conn: nopConn{}, gate: gate}
+	a.limiter = gate.newAgentLimiter()
+	return a
+}
+
+func TestRateLimitActions(t *testing.T) {
+	for _, c := range []struct {
+		action  RateLimitAction
+		handled []bool
+		wantErr bool
+	}{
+		{RateLimitDrop, []bool{true, true, false}, false},
+		{RateLimitDisconnect, []bool{true, true, false}, true},
+		{RateLimitDelay, []bool{true, true, true}, false},
+	} {
+		var limited []reflect.Type
+		a := newLimitAgent(&Gate{MsgRate: 4, MsgBurst: 2, RateLimitAction: c.action}, &limited)
+
+		start := time.Now()
+		for i, want := range c.handled {
+			ok, err := a.limitData([]byte("msg"))
+			if ok != want {
+				t.Fatalf("action %v: message %v handled %v, want %v", c.action, i, ok, want)
+			}
+			if (err != nil) != (c.wantErr && !want) {
+				t.Fatalf("action %v: message %v error %v", c.action, i, err)
+			}
+		}
+		if len(limited) != 1 || limited[0] != nil {
+			t.Fatalf("action %v: OnRateLimit called with %v", c.action, limited)
+		}
+		// the third message waits for a token at 4 per second
+		elapsed := time.Since(start)
+		if c.action == RateLimitDelay && elapsed < 200*time.Millisecond {
+			t.Fatalf("delayed %v, want 250ms", elapsed)
+		}
+		if c.action != RateLimitDelay && elapsed > 100*time.Millisecond {
+			t.Fatalf("action %v: delayed %v", c.action, elapsed)
+		}
+	}
+}
+
+func TestByteRate(t *testing.T) {
+	var limited []reflect.Type
+	a := newLimitAgent(&Gate{ByteRate: 1, ByteBurst: 10}, &limited)
+
+	for i, want := range []bool{true, true, false} {
+		ok, _ := a.limitData(make([]byte, 4))
+		if ok != want {
+			t.Fatalf("message %v handled %v, want %v", i, ok, want)
+		}
+	}
+}
+
+// MsgRates limits a type of message only, requests included
+func TestMsgRates(t *testing.T) {
+	type Other struct{}
+	processor := json.NewProcessor()
+	processor.Register(&Hello{})
+	processor.Register(&Other{})
+
+	helloType := reflect.TypeOf(&Hello{})
+	var limited []reflect.Type
+	a := newLimitAgent(&Gate{
+		Processor: processor,
+		MsgRates:  map[reflect.Type]RateLimit{helloType: {Rate: 0.001, Burst: 1}},
+	}, &limited)
+
+	for i, c := range []struct {
+		data string
+		want bool
+	}{
+		{`{"Hello":{"Name":"leaf"}}`, true},
+		{`{"Other":{}}`, true},
+		{`{"Hello":{"Name":"leaf"}}`, false},
+		{`{"Other":{}}`, true},
+	} {
+		msg, err := processor.Unmarshal([]byte(c.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, _ := a.limitMsg(msg)
+		if ok != c.want {
+			t.Fatalf("message %v handled %v, want %v", i, ok, c.want)
+		}
+	}
+	if len(limited) != 1 || limited[0] != helloType {
+		t.Fatalf("OnRateLimit called with %v", limited)
+	}
+}
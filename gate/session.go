@@ -0,0 +1,436 @@
+package gate
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
+	"net"
+	"sync"
+	"time"
+)
+
+// resumable sessions
+//
+// every message of a conn starts with a type byte, the first message of the
+// client is a hello:
+//
+//	client hello:   | 1 | token (16 bytes, zero for a new session) | ack (uint64) |
+//	server welcome: | 1 | token (16 bytes) | resumed (1 byte) |
+//	client ack:     | 2 | ack (uint64) |
+//	client data:    | 3 | message |
+//	server data:    | 3 | seq (uint64) | message |
+//
+// integers are big endian, seq of the server starts at 1 and ack is the last
+// seq received by the client. a client reconnecting within ResumeWindow sends
+// the token and its ack, the server replays the messages after ack and the
+// agent lives on with its UserData. resumed is 0 if the session is gone, the
+// client should start over then. over websocket every message is a binary
+// frame, whatever the processor
+const (
+	sessHello byte = 1
+	sessAck   byte = 2
+	sessData  byte = 3
+)
+
+const (
+	sessTokenLen = 16
+	sessHelloLen = 1 + sessTokenLen + 8
+)
+
+type sessionToken [sessTokenLen]byte
+
+var errSessionClosed = errors.New("session closed")
+
+// session is the conn of an agent which outlives the network conns
+type session struct {
+	sync.Mutex
+	cond       *sync.Cond
+	gate       *Gate
+	token      sessionToken
+	agent      *agent
+	conn       network.Conn
+	connDone   chan struct{}
+	readConn   network.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	seq        uint64
+	pending    [][]byte // unacked messages, seq of pending[0] is seq-len(pending)+1
+	replaying  bool     // the messages are queued in pending until conn is replayed
+	closeFlag  bool
+	timer      *time.Timer
+}
+
+func newSession(gate *Gate) *session {
+	s := new(session)
+	s.cond = sync.NewCond(s)
+	s.gate = gate
+	rand.Read(s.token[:])
+	return s
+}
+
+// attach makes conn the conn of the session, replays the messages after ack
+// and returns a channel closed once conn is detached
+func (s *session) attach(conn network.Conn, ack uint64, resumed bool) (<-chan struct{}, bool) {
+	s.Lock()
+	if s.closeFlag {
+		s.Unlock()
+		return nil, false
+	}
+	first := s.seq - uint64(len(s.pending)) + 1
+	if resumed && (ack+1 < first || ack > s.seq) {
+		s.Unlock()
+		return nil, false
+	}
+
+	if s.conn != nil {
+		// the client reconnects before the old conn is found broken
+		s.conn.Destroy()
+		close(s.connDone)
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.conn = conn
+	s.connDone = make(chan struct{})
+	s.localAddr = conn.LocalAddr()
+	s.remoteAddr = conn.RemoteAddr()
+	s.replaying = true
+	if resumed {
+		s.trim(ack)
+	} else {
+		ack = s.seq
+	}
+	done := s.connDone
+	s.cond.Broadcast()
+	s.Unlock()
+
+	welcome := make([]byte, 1+sessTokenLen+1)
+	welcome[0] = sessHello
+	copy(welcome[1:], s.token[:])
+	if resumed {
+		welcome[1+sessTokenLen] = 1
+	}
+	conn.WriteMsg(welcome)
+	s.replay(conn, ack)
+	return done, true
+}
+
+// replay writes the messages after seq to conn without the lock held, the
+// messages written meanwhile are queued and replayed in order too
+func (s *session) replay(conn network.Conn, seq uint64) {
+	for {
+		s.Lock()
+		if s.conn != conn {
+			s.Unlock()
+			return
+		}
+		n := len(s.pending)
+		if s.seq-seq < uint64(n) {
+			n = int(s.seq - seq)
+		}
+		if n == 0 {
+			s.replaying = false
+			s.Unlock()
+			return
+		}
+		msgs := append([][]byte(nil), s.pending[len(s.pending)-n:]...)
+		first := s.seq - uint64(n) + 1
+		seq = s.seq
+		s.Unlock()
+
+		for i, msg := range msgs {
+			conn.WriteMsg(dataHeader(first+uint64(i)), msg)
+		}
+	}
+}
+
+// detach is called once conn is broken, the session is closed if the client
+// doesn't come back within ResumeWindow
+func (s *session) detach(conn network.Conn) {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn != conn {
+		return
+	}
+
+	s.conn = nil
+	close(s.connDone)
+	if !s.closeFlag {
+		s.timer = time.AfterFunc(s.gate.ResumeWindow, s.expire)
+	}
+}
+
+func (s *session) expire() {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		s.closeFlag = true
+		s.cond.Broadcast()
+	}
+}
+
+// trim drops the messages acked by the client
+func (s *session) trim(ack uint64) {
+	if ack > s.seq {
+		return
+	}
+	if n := len(s.pending) - int(s.seq-ack); n > 0 {
+		for i := 0; i < n; i++ {
+			s.pending[i] = nil
+		}
+		s.pending = s.pending[n:]
+	}
+}
+
+func dataHeader(seq uint64) []byte {
+	b := make([]byte, 9)
+	b[0] = sessData
+	binary.BigEndian.PutUint64(b[1:], seq)
+	return b
+}
+
+// goroutine not safe
+func (s *session) ReadMsg() ([]byte, error) {
+	for {
+		s.Lock()
+		for s.conn == nil && !s.closeFlag {
+			s.cond.Wait()
+		}
+		conn := s.conn
+		s.Unlock()
+		if conn == nil {
+			return nil, errSessionClosed
+		}
+
+		data, err := conn.ReadMsg()
+		if err != nil {
+			log.Debug("session read message: %v", err)
+			s.detach(conn)
+			continue
+		}
+		if len(data) == 0 {
+			network.ReleaseMsg(conn, data)
+			continue
+		}
+
+		switch data[0] {
+		case sessAck:
+			if len(data) == 9 {
+				s.Lock()
+				s.trim(binary.BigEndian.Uint64(data[1:]))
+				s.Unlock()
+			}
+			network.ReleaseMsg(conn, data)
+		case sessData:
+			s.readConn = conn
+			return data[1:], nil
+		default:
+			network.ReleaseMsg(conn, data)
+			log.Debug("invalid session message type %v", data[0])
+			conn.Destroy()
+		}
+	}
+}
+
+func (s *session) ReleaseMsg(b []byte) {
+	if s.readConn != nil {
+		network.ReleaseMsg(s.readConn, b)
+	}
+}
+
+func (s *session) WriteMsg(args ...[]byte) error {
+	// get len
+	var msgLen int
+	for i := 0; i < len(args); i++ {
+		msgLen += len(args[i])
+	}
+
+	// merge the args, the message is kept until acked
+	msg := make([]byte, 0, msgLen)
+	for i := 0; i < len(args); i++ {
+		msg = append(msg, args[i]...)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.closeFlag {
+		return nil
+	}
+
+	s.seq++
+	s.pending = append(s.pending, msg)
+	if len(s.pending) > s.gate.ResumeBuffer {
+		// the client can't resume from before the oldest message
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+	}
+	if s.conn == nil || s.replaying {
+		return nil
+	}
+	return s.conn.WriteMsg(dataHeader(s.seq), msg)
+}
+
+func (s *session) LocalAddr() net.Addr {
+	s.Lock()
+	defer s.Unlock()
+	return s.localAddr
+}
+
+func (s *session) RemoteAddr() net.Addr {
+	s.Lock()
+	defer s.Unlock()
+	return s.remoteAddr
+}
+
+func (s *session) Close() {
+	s.close(false)
+}
+
+func (s *session) Destroy() {
+	s.close(true)
+}
+
+func (s *session) close(destroy bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.closeFlag = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.conn != nil {
+		if destroy {
+			s.conn.Destroy()
+		} else {
+			s.conn.Close()
+		}
+	}
+	s.cond.Broadcast()
+}
+
+// sessions of a gate
+type sessionSet struct {
+	sync.Mutex
+	sessions map[sessionToken]*session
+	wg       sync.WaitGroup
+}
+
+// sessionAgent is the network agent of a conn with resumable sessions
+type sessionAgent struct {
+	gate  *Gate
+	conn  network.Conn
+	agent *agent // guarded by the mutex of gate.sessions
+}
+
+func (a *sessionAgent) Run() {
+	data, err := a.conn.ReadMsg()
+	if err != nil {
+		log.Debug("read message: %v", err)
+		return
+	}
+	if len(data) != sessHelloLen || data[0] != sessHello {
+		network.ReleaseMsg(a.conn, data)
+		log.Debug("invalid session hello")
+		return
+	}
+	var token sessionToken
+	copy(token[:], data[1:])
+	ack := binary.BigEndian.Uint64(data[1+sessTokenLen:])
+	network.ReleaseMsg(a.conn, data)
+
+	done := a.resume(token, ack)
+	if done == nil {
+		done = a.open()
+	}
+	if done != nil {
+		<-done
+	}
+}
+
+func (a *sessionAgent) resume(token sessionToken, ack uint64) <-chan struct{} {
+	if token == (sessionToken{}) {
+		return nil
+	}
+
+	set := &a.gate.sessions
+	set.Lock()
+	s := set.sessions[token]
+	set.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	done, ok := s.attach(a.conn, ack, true)
+	if !ok {
+		log.Debug("session of %v can't be resumed", a.conn.RemoteAddr())
+		s.Destroy()
+		return nil
+	}
+	set.Lock()
+	a.agent = s.agent
+	set.Unlock()
+	if a.gate.AgentChanRPC != nil {
+		a.gate.AgentChanRPC.Go("ResumeAgent", s.agent)
+	}
+	return done
+}
+
+func (a *sessionAgent) open() <-chan struct{} {
+	s := newSession(a.gate)
+	s.agent = &agent{conn: s, gate: a.gate, id: nextSessionID()}
+	done, _ := s.attach(a.conn, 0, false)
+
+	set := &a.gate.sessions
+	set.Lock()
+	if set.sessions == nil {
+		set.Unlock()
+		s.Destroy()
+		return nil
+	}
+	set.sessions[s.token] = s
+	set.wg.Add(1)
+	a.agent = s.agent
+	set.Unlock()
+
+	if a.gate.AgentChanRPC != nil {
+		a.gate.AgentChanRPC.Go("NewAgent", s.agent)
+	}
+	go func() {
+		s.agent.Run()
+
+		// cleanup
+		s.Close()
+		set.Lock()
+		delete(set.sessions, s.token)
+		set.Unlock()
+		s.agent.OnClose()
+
+		set.wg.Done()
+	}()
+	return done
+}
+
+func (a *sessionAgent) OnClose() {}
+
+func (gate *Gate) openSessions() {
+	gate.sessions.Lock()
+	gate.sessions.sessions = make(map[sessionToken]*session)
+	gate.sessions.Unlock()
+}
+
+// closeSessions closes the sessions left after the servers are closed
+func (gate *Gate) closeSessions() {
+	gate.sessions.Lock()
+	sessions := gate.sessions.sessions
+	gate.sessions.sessions = nil
+	gate.sessions.Unlock()
+
+	for _, s := range sessions {
+		s.Destroy()
+	}
+	gate.sessions.wg.Wait()
+}
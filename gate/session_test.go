@@ -0,0 +1,208 @@
+package gate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/gorilla/websocket"
+	"github.com/name5566/leaf/network/json"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+type Hello struct {
+	Name string
+}
+
+// sessClient speaks the session protocol over tcp with 2 bytes lengths or
+// over websocket with binary frames
+type sessClient struct {
+	t    *testing.T
+	conn net.Conn
+	ws   *websocket.Conn
+}
+
+func dialSession(t *testing.T, network, addr string, token sessionToken, ack uint64) (*sessClient, sessionToken, bool) {
+	c := &sessClient{t: t}
+	var err error
+	for i := 0; i < 100; i++ {
+		if network == "ws" {
+			c.ws, _, err = websocket.DefaultDialer.Dial("ws://"+addr, nil)
+		} else {
+			c.conn, err = net.Dial("tcp", addr)
+		}
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := make([]byte, sessHelloLen)
+	hello[0] = sessHello
+	copy(hello[1:], token[:])
+	binary.BigEndian.PutUint64(hello[1+sessTokenLen:], ack)
+	c.write(hello)
+
+	welcome := c.read()
+	if len(welcome) != 1+sessTokenLen+1 || welcome[0] != sessHello {
+		t.Fatalf("invalid welcome % x", welcome)
+	}
+	copy(token[:], welcome[1:])
+	return c, token, welcome[1+sessTokenLen] == 1
+}
+
+func (c *sessClient) write(msg []byte) {
+	if c.ws != nil {
+		if err := c.ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+			c.t.Fatal(err)
+		}
+		return
+	}
+
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	if _, err := c.conn.Write(b); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *sessClient) read() []byte {
+	if c.ws != nil {
+		c.ws.SetReadDeadline(time.Now().Add(3 * time.Second))
+		msgType, b, err := c.ws.ReadMessage()
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		// the session headers aren't valid utf-8
+		if msgType != websocket.BinaryMessage {
+			c.t.Fatalf("frame type %v, want binary", msgType)
+		}
+		return b
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	var n [2]byte
+	if _, err := io.ReadFull(c.conn, n[:]); err != nil {
+		c.t.Fatal(err)
+	}
+	b := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(c.conn, b); err != nil {
+		c.t.Fatal(err)
+	}
+	return b
+}
+
+func (c *sessClient) close() {
+	if c.ws != nil {
+		c.ws.Close()
+	} else {
+		c.conn.Close()
+	}
+}
+
+func (c *sessClient) send(name string) {
+	c.write(append([]byte{sessData}, `{"Hello":{"Name":"`+name+`"}}`...))
+}
+
+func (c *sessClient) ack(seq uint64) {
+	b := make([]byte, 9)
+	b[0] = sessAck
+	binary.BigEndian.PutUint64(b[1:], seq)
+	c.write(b)
+}
+
+func (c *sessClient) expect(seq uint64, name string) {
+	b := c.read()
+	want := append(dataHeader(seq), `{"Hello":{"Name":"`+name+`"}}`...)
+	if !bytes.Equal(b, want) {
+		c.t.Fatalf("got %q, want %q", b, want)
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	testSessionResume(t, "tcp", "127.0.0.1:13566")
+}
+
+// the json processor sends text frames, not with sessions
+func TestSessionResumeWS(t *testing.T) {
+	testSessionResume(t, "ws", "127.0.0.1:13570")
+}
+
+func testSessionResume(t *testing.T, network, addr string) {
+	agents := make(chan Agent, 1)
+	processor := json.NewProcessor()
+	processor.Register(&Hello{})
+	processor.SetHandler(&Hello{}, func(args []interface{}) {
+		a := args[1].(Agent)
+		if args[0].(*Hello).Name == "first" {
+			agents <- a
+		}
+		a.WriteMsg(args[0])
+	})
+
+	gate := &Gate{
+		MaxConnNum:      10,
+		PendingWriteNum: 10,
+		MaxMsgLen:       4096,
+		Processor:       processor,
+		ResumeWindow:    200 * time.Millisecond,
+	}
+	if network == "ws" {
+		gate.WSAddr = addr
+		gate.HTTPTimeout = 10 * time.Second
+	} else {
+		gate.TCPAddr = addr
+		gate.LenMsgLen = 2
+	}
+	closeSig := make(chan bool)
+	done := make(chan struct{})
+	go func() {
+		gate.Run(closeSig)
+		close(done)
+	}()
+	defer func() {
+		close(closeSig)
+		<-done
+	}()
+
+	// open
+	c, token, resumed := dialSession(t, network, addr, sessionToken{}, 0)
+	if resumed {
+		t.Fatal("new session resumed")
+	}
+	c.send("first")
+	c.expect(1, "first")
+	c.send("second")
+	c.expect(2, "second")
+	c.ack(1)
+	a := <-agents
+
+	// drop, the agent writes meanwhile
+	c.close()
+	a.WriteMsg(&Hello{Name: "third"})
+
+	// resume with ack, the unacked messages are replayed in order
+	c, token2, resumed := dialSession(t, network, addr, token, 1)
+	if !resumed || token2 != token {
+		t.Fatal("session not resumed")
+	}
+	c.expect(2, "second")
+	c.expect(3, "third")
+	c.send("fourth")
+	c.expect(4, "fourth")
+	c.ack(4)
+
+	// expire
+	c.close()
+	time.Sleep(3 * gate.ResumeWindow)
+	c, token2, resumed = dialSession(t, network, addr, token, 4)
+	defer c.close()
+	if resumed || token2 == token {
+		t.Fatal("expired session resumed")
+	}
+}
@@ -45,8 +45,8 @@ func Run(mods ...module.Module) {
 	sig := <-c
 	log.Release("Leaf closing down (signal: %v)", sig)
 
-	//销毁
+	//销毁 模块关闭时 gate 可能仍在排空连接并转发消息 最后关闭集群
 	console.Destroy()
-	cluster.Destroy()
 	module.Destroy()
+	cluster.Destroy()
 }
@@ -7,6 +7,7 @@ import (
 	"time" // Go 标准库 时间处理
 
 	"github.com/name5566/leaf/chanrpc" // chanrpc 包 实现异步 RPC
+	"github.com/name5566/leaf/cluster" // cluster 包 实现跨节点 RPC
 	"github.com/name5566/leaf/console" // console 包 实现控制台命令
 	"github.com/name5566/leaf/go"      // g 包 管理协程池
 	"github.com/name5566/leaf/timer"   // timer 包 定时器
@@ -21,6 +22,7 @@ type Skeleton struct {
 	g                  *g.Go             // 协程池实例
 	dispatcher         *timer.Dispatcher // 定时器分发器实例
 	client             *chanrpc.Client   // 异步调用客户端
+	clusterClient      *cluster.Client   // 跨节点异步调用客户端
 	server             *chanrpc.Server   // RPC 服务器实例
 	commandServer      *chanrpc.Server   // 命令行 RPC 服务器
 }
@@ -46,6 +48,8 @@ func (s *Skeleton) Init() {
 	s.dispatcher = timer.NewDispatcher(s.TimerDispatcherLen)
 	// 创建异步调用客户端
 	s.client = chanrpc.NewClient(s.AsynCallLen)
+	// 创建跨节点异步调用客户端
+	s.clusterClient = cluster.NewClient(s.AsynCallLen)
 	// 使用用户提供的 RPC 服务器
 	s.server = s.ChanRPCServer
 
@@ -68,15 +72,19 @@ func (s *Skeleton) Run(closeSig chan bool) {
 			// 关闭普通 RPC
 			s.server.Close()
 			// 等待协程池和异步调用全部空闲后再关闭
-			for !s.g.Idle() || !s.client.Idle() {
+			for !s.g.Idle() || !s.client.Idle() || !s.clusterClient.Idle() {
 				s.g.Close()
 				s.client.Close()
+				s.clusterClient.Close()
 			}
 			// 退出循环
 			return
 		// 异步调用返回结果
 		case ri := <-s.client.ChanAsynRet:
 			s.client.Cb(ri)
+		// 跨节点异步调用返回结果
+		case ri := <-s.clusterClient.ChanAsynRet:
+			s.clusterClient.Cb(ri)
 		// RPC 请求处理
 		case ci := <-s.server.ChanCall:
 			s.server.Exec(ci)
@@ -142,6 +150,17 @@ func (s *Skeleton) AsynCall(server *chanrpc.Server, id interface{}, args ...inte
 	s.client.AsynCall(id, args...)
 }
 
+// ClusterAsynCall 对节点 p 上名为 server 的 RPC 服务器发起异步调用
+// 回调在模块自己的 goroutine 中执行
+func (s *Skeleton) ClusterAsynCall(p *cluster.Peer, server string, id interface{}, args ...interface{}) {
+	if s.AsynCallLen == 0 {
+		panic("invalid AsynCallLen")
+	}
+
+	s.clusterClient.Attach(p, server)
+	s.clusterClient.AsynCall(id, args...)
+}
+
 // RegisterChanRPC 注册一个 RPC 方法
 func (s *Skeleton) RegisterChanRPC(id interface{}, f interface{}) {
 	if s.ChanRPCServer == nil {
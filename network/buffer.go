@@ -0,0 +1,46 @@
+package network
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// read buffers are pooled in size classes of powers of two,
+// from 1 << minBufferShift to 1 << maxBufferShift bytes
+const (
+	minBufferShift = 6
+	maxBufferShift = 20
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+func bufferClass(n int) int {
+	if n <= 1<<minBufferShift {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferShift
+}
+
+// the buffer is not pooled if n is too large
+func getBuffer(n int) *[]byte {
+	c := bufferClass(n)
+	if c >= len(bufferPools) {
+		b := make([]byte, n)
+		return &b
+	}
+
+	if bp, ok := bufferPools[c].Get().(*[]byte); ok {
+		*bp = (*bp)[:n]
+		return bp
+	}
+	b := make([]byte, n, 1<<(c+minBufferShift))
+	return &b
+}
+
+func putBuffer(bp *[]byte) {
+	c := bufferClass(cap(*bp))
+	if c >= len(bufferPools) || cap(*bp) != 1<<(c+minBufferShift) {
+		return
+	}
+	bufferPools[c].Put(bp)
+}
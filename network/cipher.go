@@ -0,0 +1,165 @@
+package network
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// session encryption of tcp messages
+//
+// on connect both ends send a frame with their X25519 public key, client first:
+// ------------------------
+// | len | public key (32) |
+// ------------------------
+// a key per direction is derived from the shared secret, then the data of every
+// message is sealed with AES-256-GCM, using the number of messages sent in that
+// direction as the nonce, so a replayed, dropped or reordered message fails to open:
+// ------------------------------
+// | len | sealed data | tag (16) |
+// ------------------------------
+// the handshake doesn't authenticate the server, use tls if that matters
+const (
+	handshakeTimeout = 10 * time.Second
+	cipherOverhead   = 16
+)
+
+type sessionCipher struct {
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	sendSeq uint64 // used by the writer goroutine only
+	recvSeq uint64 // used by the reader only
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func nonce(seq uint64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], seq)
+	return n
+}
+
+func (c *sessionCipher) seal(args [][]byte) []byte {
+	var l int
+	for _, arg := range args {
+		l += len(arg)
+	}
+	b := make([]byte, 0, l+cipherOverhead)
+	for _, arg := range args {
+		b = append(b, arg...)
+	}
+
+	b = c.send.Seal(b[:0], nonce(c.sendSeq), b, nil)
+	c.sendSeq++
+	return b
+}
+
+// opens data in place
+func (c *sessionCipher) open(data []byte) ([]byte, error) {
+	b, err := c.recv.Open(data[:0], nonce(c.recvSeq), data, nil)
+	if err != nil {
+		return nil, errors.New("message authentication failed")
+	}
+	c.recvSeq++
+	return b, nil
+}
+
+// goroutine not safe
+// must be called before the conn is used
+func (tcpConn *TCPConn) handshake(server bool) error {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	tcpConn.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tcpConn.conn.SetDeadline(time.Time{})
+
+	var peer []byte
+	if server {
+		peer, err = tcpConn.readHandshake(32)
+		if err == nil {
+			err = tcpConn.writeHandshake(key.PublicKey().Bytes())
+		}
+	} else {
+		err = tcpConn.writeHandshake(key.PublicKey().Bytes())
+		if err == nil {
+			peer, err = tcpConn.readHandshake(32)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	peerKey, err := ecdh.X25519().NewPublicKey(peer)
+	if err != nil {
+		return err
+	}
+	secret, err := key.ECDH(peerKey)
+	if err != nil {
+		return err
+	}
+
+	clientKey, serverKey := key.PublicKey().Bytes(), peer
+	if server {
+		clientKey, serverKey = peer, key.PublicKey().Bytes()
+	}
+	salt := append(append([]byte(nil), clientKey...), serverKey...)
+	c2s, err := hkdf.Key(sha256.New, secret, salt, "leaf client to server", 32)
+	if err != nil {
+		return err
+	}
+	s2c, err := hkdf.Key(sha256.New, secret, salt, "leaf server to client", 32)
+	if err != nil {
+		return err
+	}
+	if server {
+		c2s, s2c = s2c, c2s
+	}
+
+	c := new(sessionCipher)
+	if c.send, err = newAEAD(c2s); err != nil {
+		return err
+	}
+	if c.recv, err = newAEAD(s2c); err != nil {
+		return err
+	}
+	tcpConn.cipher = c
+	return nil
+}
+
+// reads a handshake frame of n bytes
+func (tcpConn *TCPConn) readHandshake(n int) ([]byte, error) {
+	l, err := tcpConn.msgParser.codec.ReadLen(tcpConn)
+	if err != nil {
+		return nil, err
+	}
+	if l != uint32(n) {
+		return nil, errors.New("invalid handshake")
+	}
+
+	b := make([]byte, l)
+	if _, err := io.ReadFull(tcpConn, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (tcpConn *TCPConn) writeHandshake(b []byte) error {
+	frame := tcpConn.msgParser.codec.AppendLen(nil, uint32(len(b)))
+	_, err := tcpConn.conn.Write(append(frame, b...))
+	return err
+}
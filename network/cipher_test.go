@@ -0,0 +1,98 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+type loopbackAgent struct {
+	conn *TCPConn
+	msgs chan []byte
+}
+
+func (a *loopbackAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		if a.msgs != nil {
+			a.msgs <- data
+		} else {
+			a.conn.WriteMsg(data)
+		}
+	}
+}
+
+func (a *loopbackAgent) OnClose() {}
+
+func TestEncrypt(t *testing.T) {
+	server := &TCPServer{
+		Addr:              "127.0.0.1:0",
+		Encrypt:           true,
+		CompressThreshold: 64,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &loopbackAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	msgs := make(chan []byte, 1)
+	conns := make(chan *TCPConn, 1)
+	client := &TCPClient{
+		Addr:              server.ln.Addr().String(),
+		Encrypt:           true,
+		CompressThreshold: 64,
+		NewAgent: func(conn *TCPConn) Agent {
+			conns <- conn
+			return &loopbackAgent{conn: conn, msgs: msgs}
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	conn := <-conns
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("leaf"), 512)} {
+		conn.WriteMsg(msg[:1], msg[1:])
+		select {
+		case data := <-msgs:
+			if !bytes.Equal(data, msg) {
+				t.Fatalf("got %q, want %q", data, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+}
+
+func TestEncryptReplay(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	msgParser := NewMsgParser()
+	server := newTCPConn(c1, 1, msgParser)
+	client := newTCPConn(c2, 1, msgParser)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.handshake(true)
+	}()
+	if err := client.handshake(false); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := client.cipher.seal([][]byte{[]byte("move")})
+	data, err := server.cipher.open(append([]byte(nil), sealed...))
+	if err != nil || string(data) != "move" {
+		t.Fatalf("open: %q %v", data, err)
+	}
+	if _, err := server.cipher.open(sealed); err == nil {
+		t.Fatal("replayed message opened")
+	}
+}
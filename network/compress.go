@@ -0,0 +1,102 @@
+package network
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// compression of tcp messages
+//
+// on connect both ends send a frame with the magic, client first and before
+// the handshake of the session encryption:
+// -----------------------
+// | len | "leaf deflate" |
+// -----------------------
+// so an end without compression fails the handshake instead of misreading
+// the flag byte in front of the data of every message
+var deflateMagic = []byte("leaf deflate")
+
+// the flag byte in front of the data of a tcp message with compression on
+const (
+	flagRaw     byte = 0
+	flagDeflate byte = 1
+)
+
+var (
+	flags        = []byte{flagRaw, flagDeflate}
+	flateWriters sync.Pool
+	flateReaders sync.Pool
+)
+
+// goroutine not safe
+// must be called before the conn is used
+func (tcpConn *TCPConn) compressHandshake(server bool) error {
+	tcpConn.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer tcpConn.conn.SetDeadline(time.Time{})
+
+	if !server {
+		if err := tcpConn.writeHandshake(deflateMagic); err != nil {
+			return err
+		}
+	}
+	b, err := tcpConn.readHandshake(len(deflateMagic))
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(b, deflateMagic) {
+		return errors.New("compression not enabled by the peer")
+	}
+	if server {
+		return tcpConn.writeHandshake(deflateMagic)
+	}
+	return nil
+}
+
+func deflate(args [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := flateWriters.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		w, err = flate.NewWriter(&buf, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer flateWriters.Put(w)
+
+	for _, arg := range args {
+		if _, err := w.Write(arg); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// the inflated data longer than maxLen is an error
+func inflate(data []byte, maxLen uint32) ([]byte, error) {
+	r, _ := flateReaders.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReader(bytes.NewReader(data))
+	} else {
+		r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	}
+	defer flateReaders.Put(r)
+
+	b, err := io.ReadAll(io.LimitReader(r, int64(maxLen)+1))
+	if err != nil {
+		return nil, err
+	}
+	if uint32(len(b)) > maxLen {
+		return nil, errors.New("message too long")
+	}
+	return b, nil
+}
@@ -0,0 +1,56 @@
+package network
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestCompression(t *testing.T) {
+	server := &TCPServer{
+		Addr:              "127.0.0.1:0",
+		MaxMsgLen:         64 * 1024,
+		CompressThreshold: 100,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &loopbackAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	msgs := make(chan []byte, 2)
+	conns := make(chan *TCPConn, 1)
+	client := &TCPClient{
+		Addr:              server.ln.Addr().String(),
+		MaxMsgLen:         64 * 1024,
+		CompressThreshold: 100,
+		NewAgent: func(conn *TCPConn) Agent {
+			conns <- conn
+			return &loopbackAgent{conn: conn, msgs: msgs}
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	conn := <-conns
+	// raw and compressed
+	for _, msg := range [][]byte{[]byte("hello"), bytes.Repeat([]byte("leaf"), 10000)} {
+		conn.WriteMsg(msg)
+		select {
+		case echo := <-msgs:
+			if !bytes.Equal(echo, msg) {
+				t.Fatalf("echo of %v bytes is %v bytes", len(msg), len(echo))
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("no echo")
+		}
+	}
+}
+
+// an end without compression fails the handshake
+func TestCompressionMismatch(t *testing.T) {
+	server := &TCPServer{CompressThreshold: 100}
+	if echo(t, server, &TCPClient{}) {
+		t.Fatal("client without compression accepted")
+	}
+}
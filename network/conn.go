@@ -1,9 +1,46 @@
 package network
 
 import (
+	"errors"
 	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// ErrReadTimeout is returned by ReadMsg when the peer sends nothing within
+// the first message timeout or the idle timeout
+var ErrReadTimeout = errors.New("read timeout")
+
+// addresses of unix domain sockets start with "unix:", for example "unix:/tmp/leaf.sock"
+const unixPrefix = "unix:"
+
+func splitAddr(addr string) (network string, address string) {
+	if strings.HasPrefix(addr, unixPrefix) {
+		return "unix", strings.TrimPrefix(addr, unixPrefix)
+	}
+	return "tcp", addr
+}
+
+// removes the socket file left by a crashed process, the socket of a live
+// process is kept and Listen fails then
+func removeStaleSocket(address string) {
+	fi, err := os.Stat(address)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+
+	conn, err := net.DialTimeout("unix", address, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(address)
+	}
+}
+
 type Conn interface {
 	ReadMsg() ([]byte, error)
 	WriteMsg(args ...[]byte) error
@@ -12,3 +49,50 @@ type Conn interface {
 	Close()
 	Destroy()
 }
+
+// MsgReleaser is implemented by the conns which may return a pooled buffer
+// from ReadMsg, such as TCPConn with the buffer pool enabled
+type MsgReleaser interface {
+	ReleaseMsg(b []byte)
+}
+
+// ReleaseMsg releases the message read from conn if conn pools its read
+// buffers, the message must not be used after that
+func ReleaseMsg(conn Conn, b []byte) {
+	if r, ok := conn.(MsgReleaser); ok {
+		r.ReleaseMsg(b)
+	}
+}
+
+type readTimeout struct {
+	firstMsgTimeout time.Duration
+	idleTimeout     time.Duration
+	msgRead         bool
+}
+
+func (t *readTimeout) deadline() time.Time {
+	d := t.idleTimeout
+	if !t.msgRead && t.firstMsgTimeout > 0 {
+		d = t.firstMsgTimeout
+	}
+	if d <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(d)
+}
+
+func (t *readTimeout) enabled() bool {
+	return t.firstMsgTimeout > 0 || t.idleTimeout > 0
+}
+
+func (t *readTimeout) checkErr(err error) error {
+	if err == nil {
+		t.msgRead = true
+		return nil
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrReadTimeout
+	}
+	return err
+}
@@ -0,0 +1,88 @@
+package network
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"testing"
+	"time"
+)
+
+// checkRead reads a message from conn and checks it's read by the time
+// expected, within a margin
+func checkRead(t *testing.T, conn Conn, wantErr error, after time.Duration) {
+	t.Helper()
+	start := time.Now()
+	_, err := conn.ReadMsg()
+	elapsed := time.Since(start)
+	if err != wantErr {
+		t.Fatalf("read error %v, want %v", err, wantErr)
+	}
+	if elapsed < after-10*time.Millisecond || elapsed > after+200*time.Millisecond {
+		t.Fatalf("read returned after %v, want %v", elapsed, after)
+	}
+}
+
+// the first message timeout applies until a message is read, the idle
+// timeout afterwards
+func TestTCPReadTimeout(t *testing.T) {
+	newPair := func() (*TCPConn, *TCPConn) {
+		c1, c2 := net.Pipe()
+		msgParser := NewMsgParser()
+		conn := newTCPConn(c1, 10, msgParser)
+		conn.setReadTimeout(50*time.Millisecond, 300*time.Millisecond)
+		return conn, newTCPConn(c2, 10, msgParser)
+	}
+
+	conn, peer := newPair()
+	checkRead(t, conn, ErrReadTimeout, 50*time.Millisecond)
+	conn.Close()
+	peer.Close()
+
+	conn, peer = newPair()
+	defer conn.Close()
+	defer peer.Close()
+	go func() {
+		peer.WriteMsg([]byte("first"))
+		time.Sleep(150 * time.Millisecond)
+		peer.WriteMsg([]byte("second"))
+	}()
+	checkRead(t, conn, nil, 0)
+	checkRead(t, conn, nil, 150*time.Millisecond)
+	checkRead(t, conn, ErrReadTimeout, 300*time.Millisecond)
+}
+
+func TestWSReadTimeout(t *testing.T) {
+	conns := make(chan *WSConn, 2)
+	block := make(chan struct{})
+	server := &WSServer{
+		Addr:            "127.0.0.1:0",
+		FirstMsgTimeout: 50 * time.Millisecond,
+		IdleTimeout:     300 * time.Millisecond,
+		NewAgent: func(conn *WSConn) Agent {
+			conns <- conn
+			return blockAgent(block)
+		},
+	}
+	server.Start()
+	defer server.Close()
+	defer close(block)
+
+	dial := func() *websocket.Conn {
+		client, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return client
+	}
+
+	client := dial()
+	defer client.Close()
+	checkRead(t, <-conns, ErrReadTimeout, 50*time.Millisecond)
+
+	client = dial()
+	defer client.Close()
+	conn := <-conns
+	client.WriteMessage(websocket.BinaryMessage, []byte("first"))
+	checkRead(t, conn, nil, 0)
+	checkRead(t, conn, ErrReadTimeout, 300*time.Millisecond)
+}
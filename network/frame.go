@@ -0,0 +1,152 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// FrameCodec reads and writes the len field in front of every tcp message,
+// a codec for a header with more than the len, such as flags, is expected to
+// check them in ReadLen and write them in AppendLen
+type FrameCodec interface {
+	// reads the header and returns the len of the data that follows
+	ReadLen(r io.Reader) (uint32, error)
+	// appends the header of a message with msgLen bytes of data to b
+	AppendLen(b []byte, msgLen uint32) []byte
+	// the max len of the header
+	MaxHeaderLen() int
+	// the max len of the data the header can describe
+	MaxLen() uint32
+}
+
+// ---------------------
+// | len (Size) | data |
+// ---------------------
+// Size must be 1, 2 or 4
+type FixedLenCodec struct {
+	Size         int
+	LittleEndian bool
+}
+
+func (c FixedLenCodec) ReadLen(r io.Reader) (uint32, error) {
+	if !c.valid() {
+		return 0, errors.New("invalid len size")
+	}
+	var b [4]byte
+	bufMsgLen := b[:c.Size]
+
+	if _, err := io.ReadFull(r, bufMsgLen); err != nil {
+		return 0, err
+	}
+
+	switch c.Size {
+	case 1:
+		return uint32(bufMsgLen[0]), nil
+	case 2:
+		if c.LittleEndian {
+			return uint32(binary.LittleEndian.Uint16(bufMsgLen)), nil
+		}
+		return uint32(binary.BigEndian.Uint16(bufMsgLen)), nil
+	case 4:
+		if c.LittleEndian {
+			return binary.LittleEndian.Uint32(bufMsgLen), nil
+		}
+		return binary.BigEndian.Uint32(bufMsgLen), nil
+	}
+	panic("bug")
+}
+
+func (c FixedLenCodec) valid() bool {
+	return c.Size == 1 || c.Size == 2 || c.Size == 4
+}
+
+func (c FixedLenCodec) AppendLen(b []byte, msgLen uint32) []byte {
+	switch c.Size {
+	case 1:
+		return append(b, byte(msgLen))
+	case 2:
+		if c.LittleEndian {
+			return binary.LittleEndian.AppendUint16(b, uint16(msgLen))
+		}
+		return binary.BigEndian.AppendUint16(b, uint16(msgLen))
+	case 4:
+		if c.LittleEndian {
+			return binary.LittleEndian.AppendUint32(b, msgLen)
+		}
+		return binary.BigEndian.AppendUint32(b, msgLen)
+	}
+	return b
+}
+
+func (c FixedLenCodec) MaxHeaderLen() int {
+	return c.Size
+}
+
+func (c FixedLenCodec) MaxLen() uint32 {
+	switch c.Size {
+	case 1:
+		return math.MaxUint8
+	case 2:
+		return math.MaxUint16
+	case 4:
+		return math.MaxUint32
+	}
+	return 0
+}
+
+// ------------------------
+// | len (uvarint) | data |
+// ------------------------
+// the len prefix used by protobuf delimited messages
+// r is read a byte at a time, TCPConn is buffered for it
+type VarintCodec struct{}
+
+func (VarintCodec) ReadLen(r io.Reader) (uint32, error) {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = &byteReader{r: r}
+	}
+
+	var x uint32
+	for i := 0; i < binary.MaxVarintLen32; i++ {
+		b, err := br.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen32-1 && b > 0xf {
+				break
+			}
+			return x | uint32(b)<<(7*i), nil
+		}
+		x |= uint32(b&0x7f) << (7 * i)
+	}
+	return 0, errors.New("varint len overflows")
+}
+
+type byteReader struct {
+	r io.Reader
+	b [1]byte
+}
+
+func (r *byteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(r.r, r.b[:])
+	return r.b[0], err
+}
+
+func (VarintCodec) AppendLen(b []byte, msgLen uint32) []byte {
+	return binary.AppendUvarint(b, uint64(msgLen))
+}
+
+func (VarintCodec) MaxHeaderLen() int {
+	return binary.MaxVarintLen32
+}
+
+func (VarintCodec) MaxLen() uint32 {
+	return math.MaxUint32
+}
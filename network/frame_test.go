@@ -0,0 +1,82 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"testing"
+)
+
+func TestFrameCodec(t *testing.T) {
+	codecs := []FrameCodec{
+		FixedLenCodec{Size: 1},
+		FixedLenCodec{Size: 2},
+		FixedLenCodec{Size: 2, LittleEndian: true},
+		FixedLenCodec{Size: 4},
+		FixedLenCodec{Size: 4, LittleEndian: true},
+		VarintCodec{},
+	}
+	for _, codec := range codecs {
+		for _, n := range []uint32{0, 1, 127, 128, 255, 16383, 16384, math.MaxUint16, codec.MaxLen()} {
+			if n > codec.MaxLen() {
+				continue
+			}
+			header := codec.AppendLen(nil, n)
+			if len(header) > codec.MaxHeaderLen() {
+				t.Fatalf("%#v: header of %v is %v bytes", codec, n, len(header))
+			}
+			// a plain reader and a byte reader
+			for _, r := range []io.Reader{struct{ io.Reader }{bytes.NewReader(header)}, bytes.NewReader(header)} {
+				if l, err := codec.ReadLen(r); err != nil || l != n {
+					t.Fatalf("%#v: read %v %v, want %v", codec, l, err, n)
+				}
+			}
+		}
+	}
+}
+
+func TestVarintCodecOverflow(t *testing.T) {
+	var codec VarintCodec
+	if _, err := codec.ReadLen(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff, 0x10})); err == nil {
+		t.Fatal("varint over 32 bits read")
+	}
+	if _, err := codec.ReadLen(bytes.NewReader([]byte{0x80})); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("truncated varint error %v", err)
+	}
+}
+
+func TestFixedLenCodecInvalidSize(t *testing.T) {
+	if _, err := (FixedLenCodec{Size: 8}).ReadLen(bytes.NewReader(make([]byte, 8))); err == nil {
+		t.Fatal("len of 8 bytes read")
+	}
+}
+
+func TestVarintCodecMsg(t *testing.T) {
+	p := NewMsgParser()
+	p.SetFrameCodec(VarintCodec{})
+	p.SetMsgLen(0, 1, 64*1024)
+
+	c1, c2 := net.Pipe()
+	w := newTCPConn(c1, 10, p)
+	r := newTCPConn(c2, 10, p)
+	defer w.Close()
+	defer r.Close()
+
+	sizes := []int{1, 127, 128, 16383, 16384, 64 * 1024}
+	go func() {
+		for _, n := range sizes {
+			w.WriteMsg(bytes.Repeat([]byte{byte(n)}, n))
+		}
+	}()
+	for _, n := range sizes {
+		data, err := r.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte(n)}, n)) {
+			t.Fatalf("read %v bytes, want %v", len(data), n)
+		}
+	}
+}
@@ -6,18 +6,44 @@ import (
 	"fmt"
 	"github.com/name5566/leaf/chanrpc"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
 	"reflect"
 )
 
+// a message is an object keyed by its id:
+// {"Hello": {"Name": "leaf"}}
+// or an envelope once SetEnvelope("id", "data") is called:
+// {"id": "Hello", "data": {"Name": "leaf"}}
+// with request ids, "@rid" is added beside the message and an error reply
+// has "@error" instead of the message:
+// {"Hello": {"Name": "leaf"}, "@rid": 1}
+// {"@error": "text", "@rid": 1}
 type Processor struct {
-	msgInfo map[string]*MsgInfo
+	msgInfo   map[string]*MsgInfo
+	msgID     map[reflect.Type]string
+	requestID bool
+	idKey     string
+	dataKey   string
 }
 
+var (
+	// ErrUnknownID is wrapped by the errors of unregistered ids in the data
+	ErrUnknownID = errors.New("unknown message id")
+	// ErrNotRegistered is wrapped by the errors of unregistered message types
+	ErrNotRegistered = errors.New("message not registered")
+)
+
+const (
+	ridKey   = "@rid"
+	errorKey = "@error"
+)
+
 type MsgInfo struct {
 	msgType       reflect.Type
 	msgRouter     *chanrpc.Server
 	msgHandler    MsgHandler
 	msgRawHandler MsgHandler
+	msgReqHandler network.MsgReqHandler
 }
 
 type MsgHandler func([]interface{})
@@ -30,9 +56,35 @@ type MsgRaw struct {
 func NewProcessor() *Processor {
 	p := new(Processor)
 	p.msgInfo = make(map[string]*MsgInfo)
+	p.msgID = make(map[reflect.Type]string)
 	return p
 }
 
+// the messages are text, see network.TextProcessor
+func (p *Processor) TextMessage() bool {
+	return true
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetRequestID(enable bool) {
+	p.requestID = enable
+}
+
+// SetEnvelope puts the id and the message under idKey and dataKey,
+// empty keys restore the object keyed by the id
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetEnvelope(idKey, dataKey string) {
+	reserved := func(key string) bool {
+		return key == ridKey || key == errorKey
+	}
+	if (idKey == "") != (dataKey == "") || idKey != "" && idKey == dataKey || reserved(idKey) || reserved(dataKey) {
+		log.Fatal("invalid json envelope keys %q and %q", idKey, dataKey)
+	}
+	p.idKey = idKey
+	p.dataKey = dataKey
+}
+
+// Register uses the type name as the id
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) Register(msg interface{}) string {
 	msgType := reflect.TypeOf(msg)
@@ -43,27 +95,50 @@ func (p *Processor) Register(msg interface{}) string {
 	if msgID == "" {
 		log.Fatal("unnamed json message")
 	}
-	if _, ok := p.msgInfo[msgID]; ok {
-		log.Fatal("message %v is already registered", msgID)
+
+	p.RegisterAs(msgID, msg)
+	return msgID
+}
+
+// RegisterAs registers msg with an explicit id, such as "auth.Login" or
+// "auth.Login.v2", the first id of a message is used for marshaling and
+// the others are aliases accepted on unmarshaling
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterAs(msgID string, msg interface{}) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		log.Fatal("json message pointer required")
+	}
+	if msgID == "" || msgID == ridKey || msgID == errorKey {
+		log.Fatal("invalid json message id %q", msgID)
+	}
+	if i, ok := p.msgInfo[msgID]; ok {
+		log.Fatal("message id %v of %v is already taken by %v", msgID, msgType, i.msgType)
 	}
 
+	if id, ok := p.msgID[msgType]; ok {
+		p.msgInfo[msgID] = p.msgInfo[id]
+		return
+	}
 	i := new(MsgInfo)
 	i.msgType = msgType
 	p.msgInfo[msgID] = i
-	return msgID
+	p.msgID[msgType] = msgID
 }
 
+// a request is routed with its id, register the function of the router
+// by network.RequestFunc to reply to it
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) SetRouter(msg interface{}, msgRouter *chanrpc.Server) {
 	msgType := reflect.TypeOf(msg)
 	if msgType == nil || msgType.Kind() != reflect.Ptr {
 		log.Fatal("json message pointer required")
 	}
-	msgID := msgType.Elem().Name()
-	i, ok := p.msgInfo[msgID]
+	msgID, ok := p.msgID[msgType]
 	if !ok {
-		log.Fatal("message %v not registered", msgID)
+		log.Fatal("message %v not registered", msgType)
 	}
+	i := p.msgInfo[msgID]
 
 	i.msgRouter = msgRouter
 }
@@ -74,35 +149,60 @@ func (p *Processor) SetHandler(msg interface{}, msgHandler MsgHandler) {
 	if msgType == nil || msgType.Kind() != reflect.Ptr {
 		log.Fatal("json message pointer required")
 	}
-	msgID := msgType.Elem().Name()
-	i, ok := p.msgInfo[msgID]
+	msgID, ok := p.msgID[msgType]
 	if !ok {
-		log.Fatal("message %v not registered", msgID)
+		log.Fatal("message %v not registered", msgType)
 	}
+	i := p.msgInfo[msgID]
 
 	i.msgHandler = msgHandler
 }
 
+// the handler runs on the goroutine of the agent, see network.HandleRequest
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetRequestHandler(msg interface{}, msgReqHandler network.MsgReqHandler) {
+	msgType := reflect.TypeOf(msg)
+	if msgType == nil || msgType.Kind() != reflect.Ptr {
+		log.Fatal("json message pointer required")
+	}
+	msgID, ok := p.msgID[msgType]
+	if !ok {
+		log.Fatal("message %v not registered", msgType)
+	}
+	i := p.msgInfo[msgID]
+
+	i.msgReqHandler = msgReqHandler
+}
+
+// the handler is shared by msgID and its aliases and gets the id of the
+// data, which may be an alias, with the raw message
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) SetRawHandler(msgID string, msgRawHandler MsgHandler) {
 	i, ok := p.msgInfo[msgID]
 	if !ok {
-		log.Fatal("message %v not registered", msgID)
+		log.Fatal("message %q not registered", msgID)
 	}
 
 	i.msgRawHandler = msgRawHandler
 }
 
 // goroutine safe
+// the handlers get the request id after userData, zero if it's not a request
 func (p *Processor) Route(msg interface{}, userData interface{}) error {
+	// request
+	var id uint32
+	if req, ok := msg.(*network.Request); ok {
+		id, msg = req.ID, req.Msg
+	}
+
 	// raw
 	if msgRaw, ok := msg.(MsgRaw); ok {
 		i, ok := p.msgInfo[msgRaw.msgID]
 		if !ok {
-			return fmt.Errorf("message %v not registered", msgRaw.msgID)
+			return fmt.Errorf("%w %q", ErrUnknownID, msgRaw.msgID)
 		}
 		if i.msgRawHandler != nil {
-			i.msgRawHandler([]interface{}{msgRaw.msgID, msgRaw.msgRawData, userData})
+			i.msgRawHandler([]interface{}{msgRaw.msgID, msgRaw.msgRawData, userData, id})
 		}
 		return nil
 	}
@@ -112,16 +212,19 @@ func (p *Processor) Route(msg interface{}, userData interface{}) error {
 	if msgType == nil || msgType.Kind() != reflect.Ptr {
 		return errors.New("json message pointer required")
 	}
-	msgID := msgType.Elem().Name()
-	i, ok := p.msgInfo[msgID]
+	msgID, ok := p.msgID[msgType]
 	if !ok {
-		return fmt.Errorf("message %v not registered", msgID)
+		return fmt.Errorf("%w: %v", ErrNotRegistered, msgType)
 	}
+	i := p.msgInfo[msgID]
 	if i.msgHandler != nil {
-		i.msgHandler([]interface{}{msg, userData})
+		i.msgHandler([]interface{}{msg, userData, id})
+	}
+	if i.msgReqHandler != nil {
+		network.HandleRequest(i.msgReqHandler, []interface{}{msg, userData, id})
 	}
 	if i.msgRouter != nil {
-		i.msgRouter.Go(msgType, msg, userData)
+		i.msgRouter.Go(msgType, msg, userData, id)
 	}
 	return nil
 }
@@ -133,41 +236,109 @@ func (p *Processor) Unmarshal(data []byte) (interface{}, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// request
+	if p.requestID {
+		var id uint32
+		if data, ok := m[ridKey]; ok {
+			err := json.Unmarshal(data, &id)
+			if err != nil {
+				return nil, err
+			}
+			delete(m, ridKey)
+		}
+		if data, ok := m[errorKey]; ok {
+			var text string
+			err := json.Unmarshal(data, &text)
+			return &network.Request{ID: id, Msg: errors.New(text)}, err
+		}
+
+		msg, err := p.unmarshal(m)
+		if err != nil {
+			return nil, err
+		}
+		return &network.Request{ID: id, Msg: msg}, nil
+	}
+
+	return p.unmarshal(m)
+}
+
+func (p *Processor) unmarshal(m map[string]json.RawMessage) (interface{}, error) {
+	// envelope
+	if p.idKey != "" {
+		rawID, ok := m[p.idKey]
+		data, ok2 := m[p.dataKey]
+		if !ok || !ok2 || len(m) != 2 {
+			return nil, errors.New("invalid json envelope")
+		}
+		var msgID string
+		err := json.Unmarshal(rawID, &msgID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid json message id: %v", err)
+		}
+		return p.unmarshalMsg(msgID, data)
+	}
+
 	if len(m) != 1 {
 		return nil, errors.New("invalid json data")
 	}
 
 	for msgID, data := range m {
-		i, ok := p.msgInfo[msgID]
-		if !ok {
-			return nil, fmt.Errorf("message %v not registered", msgID)
-		}
-
-		// msg
-		if i.msgRawHandler != nil {
-			return MsgRaw{msgID, data}, nil
-		} else {
-			msg := reflect.New(i.msgType.Elem()).Interface()
-			return msg, json.Unmarshal(data, msg)
-		}
+		return p.unmarshalMsg(msgID, data)
 	}
 
 	panic("bug")
 }
 
+func (p *Processor) unmarshalMsg(msgID string, data json.RawMessage) (interface{}, error) {
+	i, ok := p.msgInfo[msgID]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownID, msgID)
+	}
+
+	// msg
+	if i.msgRawHandler != nil {
+		return MsgRaw{msgID, data}, nil
+	} else {
+		msg := reflect.New(i.msgType.Elem()).Interface()
+		return msg, json.Unmarshal(data, msg)
+	}
+}
+
 // goroutine safe
 func (p *Processor) Marshal(msg interface{}) ([][]byte, error) {
+	// request
+	var id uint32
+	if req, ok := msg.(*network.Request); ok {
+		if !p.requestID {
+			return nil, errors.New("request id not enabled")
+		}
+		id, msg = req.ID, req.Msg
+	}
+	if err, ok := msg.(error); ok && p.requestID {
+		data, err := json.Marshal(map[string]interface{}{errorKey: err.Error(), ridKey: id})
+		return [][]byte{data}, err
+	}
+
 	msgType := reflect.TypeOf(msg)
 	if msgType == nil || msgType.Kind() != reflect.Ptr {
 		return nil, errors.New("json message pointer required")
 	}
-	msgID := msgType.Elem().Name()
-	if _, ok := p.msgInfo[msgID]; !ok {
-		return nil, fmt.Errorf("message %v not registered", msgID)
+	msgID, ok := p.msgID[msgType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrNotRegistered, msgType)
 	}
 
 	// data
-	m := map[string]interface{}{msgID: msg}
+	var m map[string]interface{}
+	if p.idKey != "" {
+		m = map[string]interface{}{p.idKey: msgID, p.dataKey: msg}
+	} else {
+		m = map[string]interface{}{msgID: msg}
+	}
+	if id != 0 {
+		m[ridKey] = id
+	}
 	data, err := json.Marshal(m)
 	return [][]byte{data}, err
 }
@@ -0,0 +1,198 @@
+package json
+
+import (
+	"bytes"
+	"errors"
+	"github.com/name5566/leaf/network"
+	"reflect"
+	"testing"
+)
+
+type Hello struct {
+	Name string
+}
+
+func marshal(t *testing.T, p *Processor, msg interface{}) []byte {
+	data, err := p.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Join(data, nil)
+}
+
+func unmarshal(t *testing.T, p *Processor, data string) interface{} {
+	msg, err := p.Unmarshal([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestMarshal(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&Hello{})
+
+	data := marshal(t, p, &Hello{Name: "leaf"})
+	if string(data) != `{"Hello":{"Name":"leaf"}}` {
+		t.Fatalf("marshaled %s", data)
+	}
+	msg := unmarshal(t, p, string(data))
+	if !reflect.DeepEqual(msg, &Hello{Name: "leaf"}) {
+		t.Fatalf("unmarshaled %#v", msg)
+	}
+}
+
+func TestMarshalRequest(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&Hello{})
+	if _, err := p.Marshal(&network.Request{ID: 1, Msg: &Hello{}}); err == nil {
+		t.Fatal("request marshaled without request ids")
+	}
+	p.SetRequestID(true)
+
+	tests := []struct {
+		msg  interface{}
+		data string
+	}{
+		{&network.Request{ID: 7, Msg: &Hello{Name: "leaf"}}, `{"@rid":7,"Hello":{"Name":"leaf"}}`},
+		// id zero isn't written
+		{&network.Request{Msg: &Hello{Name: "leaf"}}, `{"Hello":{"Name":"leaf"}}`},
+		{&network.Request{ID: 7, Msg: network.ReplyError("bad name")}, `{"@error":"bad name","@rid":7}`},
+	}
+	for _, test := range tests {
+		data := marshal(t, p, test.msg)
+		if string(data) != test.data {
+			t.Fatalf("marshaled %s, want %s", data, test.data)
+		}
+		req := unmarshal(t, p, test.data).(*network.Request)
+		want := test.msg.(*network.Request)
+		if err, ok := want.Msg.(error); ok {
+			if req.ID != want.ID || req.Msg.(error).Error() != err.Error() {
+				t.Fatalf("unmarshaled %v %v", req.ID, req.Msg)
+			}
+		} else if !reflect.DeepEqual(req, want) {
+			t.Fatalf("unmarshaled %v %#v", req.ID, req.Msg)
+		}
+	}
+
+	// a message without a request id
+	req := unmarshal(t, p, `{"Hello":{"Name":"leaf"}}`).(*network.Request)
+	if req.ID != 0 {
+		t.Fatalf("request id %v", req.ID)
+	}
+}
+
+func TestRouteRequest(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&Hello{})
+	p.SetRequestID(true)
+	p.SetRequestHandler(&Hello{}, func(args []interface{}) (interface{}, error) {
+		if args[0].(*Hello).Name == "" {
+			return nil, network.ReplyError("name required")
+		}
+		return args[0], nil
+	})
+
+	r := &replier{p: p, t: t}
+	for _, data := range []string{`{"Hello":{"Name":"leaf"},"@rid":1}`, `{"Hello":{},"@rid":2}`} {
+		if err := p.Route(unmarshal(t, p, data), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{`{"@rid":1,"Hello":{"Name":"leaf"}}`, `{"@error":"name required","@rid":2}`}
+	if !reflect.DeepEqual(r.written, want) {
+		t.Fatalf("replied %q", r.written)
+	}
+}
+
+type replier struct {
+	p       *Processor
+	t       *testing.T
+	written []string
+}
+
+func (r *replier) Reply(id uint32, msg interface{}) {
+	r.written = append(r.written, string(marshal(r.t, r.p, &network.Request{ID: id, Msg: msg})))
+}
+
+type Login struct {
+	User string
+}
+
+func TestRegisterAs(t *testing.T) {
+	p := NewProcessor()
+	p.RegisterAs("auth.Login", &Login{})
+	p.RegisterAs("auth.Login.v1", &Login{})
+	if p.msgInfo["auth.Login"] != p.msgInfo["auth.Login.v1"] {
+		t.Fatal("aliases registered apart")
+	}
+
+	// the first id is marshaled, the aliases are unmarshaled
+	if data := marshal(t, p, &Login{User: "leaf"}); string(data) != `{"auth.Login":{"User":"leaf"}}` {
+		t.Fatalf("marshaled %s", data)
+	}
+	msg := unmarshal(t, p, `{"auth.Login.v1":{"User":"leaf"}}`)
+	if !reflect.DeepEqual(msg, &Login{User: "leaf"}) {
+		t.Fatalf("unmarshaled %#v", msg)
+	}
+
+	// the raw handler gets the alias
+	var rawID string
+	p.SetRawHandler("auth.Login", func(args []interface{}) {
+		rawID = args[0].(string)
+	})
+	if err := p.Route(unmarshal(t, p, `{"auth.Login.v1":{}}`), nil); err != nil {
+		t.Fatal(err)
+	}
+	if rawID != "auth.Login.v1" {
+		t.Fatalf("raw handler got %q", rawID)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&Hello{})
+	p.SetEnvelope("id", "data")
+	p.SetRequestID(true)
+
+	data := marshal(t, p, &network.Request{ID: 7, Msg: &Hello{Name: "leaf"}})
+	if string(data) != `{"@rid":7,"data":{"Name":"leaf"},"id":"Hello"}` {
+		t.Fatalf("marshaled %s", data)
+	}
+	req := unmarshal(t, p, string(data)).(*network.Request)
+	if req.ID != 7 || !reflect.DeepEqual(req.Msg, &Hello{Name: "leaf"}) {
+		t.Fatalf("unmarshaled %v %#v", req.ID, req.Msg)
+	}
+
+	for _, data := range []string{
+		`{"id":"Hello"}`,
+		`{"data":{}}`,
+		`{"id":"Hello","data":{},"extra":1}`,
+		`{"id":1,"data":{}}`,
+		`{"Hello":{}}`,
+	} {
+		if _, err := p.Unmarshal([]byte(data)); err == nil {
+			t.Fatalf("malformed envelope %s unmarshaled", data)
+		}
+	}
+}
+
+func TestUnknownID(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&Hello{})
+
+	if _, err := p.Unmarshal([]byte(`{"Login":{}}`)); !errors.Is(err, ErrUnknownID) {
+		t.Fatalf("unknown id error %v", err)
+	}
+	p.SetEnvelope("id", "data")
+	if _, err := p.Unmarshal([]byte(`{"id":"Login","data":{}}`)); !errors.Is(err, ErrUnknownID) {
+		t.Fatalf("unknown id error %v", err)
+	}
+
+	if _, err := p.Marshal(&Login{}); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("marshal error %v", err)
+	}
+	if err := p.Route(&Login{}, nil); !errors.Is(err, ErrNotRegistered) {
+		t.Fatalf("route error %v", err)
+	}
+}
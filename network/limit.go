@@ -0,0 +1,162 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/util"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// counts of rejected connections by reason
+type RejectStats struct {
+	Denied      uint64 // not in AllowCIDRs or in DenyCIDRs
+	RateLimited uint64 // over AcceptRate
+	PerIPLimit  uint64 // over MaxConnPerIP
+	MaxConn     uint64 // over MaxConnNum
+}
+
+// reasons of acquire failures
+var (
+	errDenied      = errors.New("connection denied")
+	errRateLimited = errors.New("connection rate limited")
+	errPerIPLimit  = errors.New("too many connections from the ip")
+)
+
+type connLimiter struct {
+	maxConnPerIP int
+	bucket       *util.TokenBucket
+	allow        []*net.IPNet
+	deny         []*net.IPNet
+	mutex        sync.Mutex
+	ipConns      map[string]int
+	denied       uint64
+	rateLimited  uint64
+	perIPLimit   uint64
+	maxConn      uint64
+}
+
+func newConnLimiter(maxConnPerIP int, acceptRate float64, acceptBurst int, allow, deny []string) (*connLimiter, error) {
+	l := new(connLimiter)
+	l.maxConnPerIP = maxConnPerIP
+	if acceptRate > 0 {
+		l.bucket = util.NewTokenBucket(acceptRate, acceptBurst)
+	}
+
+	var err error
+	l.allow, err = parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	l.deny, err = parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	l.ipConns = make(map[string]int)
+	return l, nil
+}
+
+// a plain ip is a single address network
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %v", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire checks a new connection from addr, an ip with or without a port,
+// the returned ip must be released when the connection is closed, addrs
+// without an ip such as unix domain sockets are only rate limited
+func (l *connLimiter) acquire(addr string) (string, error) {
+	ip := net.ParseIP(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		ip = net.ParseIP(host)
+	}
+
+	if ip != nil {
+		if len(l.allow) > 0 && !containsIP(l.allow, ip) || containsIP(l.deny, ip) {
+			atomic.AddUint64(&l.denied, 1)
+			log.Debug("connection from %v denied", addr)
+			return "", errDenied
+		}
+	}
+
+	if l.bucket != nil && !l.bucket.Allow() {
+		atomic.AddUint64(&l.rateLimited, 1)
+		log.Debug("connection from %v rate limited", addr)
+		return "", errRateLimited
+	}
+
+	if ip == nil || l.maxConnPerIP <= 0 {
+		return "", nil
+	}
+
+	key := ip.String()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.ipConns[key] >= l.maxConnPerIP {
+		atomic.AddUint64(&l.perIPLimit, 1)
+		log.Debug("too many connections from %v", key)
+		return "", errPerIPLimit
+	}
+	l.ipConns[key]++
+	return key, nil
+}
+
+func (l *connLimiter) release(ip string) {
+	if ip == "" {
+		return
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.ipConns[ip] <= 1 {
+		delete(l.ipConns, ip)
+	} else {
+		l.ipConns[ip]--
+	}
+}
+
+func (l *connLimiter) rejectMaxConn() {
+	atomic.AddUint64(&l.maxConn, 1)
+	log.Debug("too many connections")
+}
+
+func (l *connLimiter) stats() RejectStats {
+	return RejectStats{
+		Denied:      atomic.LoadUint64(&l.denied),
+		RateLimited: atomic.LoadUint64(&l.rateLimited),
+		PerIPLimit:  atomic.LoadUint64(&l.perIPLimit),
+		MaxConn:     atomic.LoadUint64(&l.maxConn),
+	}
+}
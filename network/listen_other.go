@@ -0,0 +1,22 @@
+//go:build !unix
+
+package network
+
+import (
+	"context"
+	"net"
+	"os"
+)
+
+// there's no umask, the socket file is chmoded after it's created
+func listenUnix(lc *net.ListenConfig, address string, mode os.FileMode) (net.Listener, error) {
+	ln, err := lc.Listen(context.Background(), "unix", address)
+	if err != nil || mode == 0 {
+		return ln, err
+	}
+	if err := os.Chmod(address, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
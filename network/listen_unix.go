@@ -0,0 +1,29 @@
+//go:build unix
+
+package network
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+)
+
+var umaskMutex sync.Mutex
+
+// the socket file is created with mode by the umask, so it's never
+// accessible with looser permissions, zero mode keeps the umask
+// the umask is of the process, files created meanwhile by the others
+// goroutines get mode as the umask too
+func listenUnix(lc *net.ListenConfig, address string, mode os.FileMode) (net.Listener, error) {
+	if mode == 0 {
+		return lc.Listen(context.Background(), "unix", address)
+	}
+
+	umaskMutex.Lock()
+	defer umaskMutex.Unlock()
+	old := syscall.Umask(int(^mode.Perm() & os.ModePerm))
+	defer syscall.Umask(old)
+	return lc.Listen(context.Background(), "unix", address)
+}
@@ -0,0 +1,227 @@
+package network
+
+import (
+	"github.com/name5566/leaf/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// what to do when the write queue of a conn is full
+type OverflowPolicy int
+
+const (
+	// destroy the conn
+	OverflowDisconnect OverflowPolicy = iota
+	// drop the oldest pending message
+	OverflowDropOldest
+	// drop the message being written
+	OverflowDropNewest
+	// wait up to OverflowTimeout for room, then destroy the conn
+	OverflowBlock
+	// replace the pending message with the same key, destroy the conn if none
+	OverflowCoalesce
+)
+
+type writeItem struct {
+	b    []byte
+	args [][]byte // written after b, not merged
+	key  string
+	seal bool // args are sealed by the session cipher
+
+	msgType int // websocket frame type, zero for the type of the conn
+}
+
+func (item *writeItem) append(bufs net.Buffers, c *sessionCipher) net.Buffers {
+	bufs = append(bufs, item.b)
+	if item.seal {
+		return append(bufs, c.seal(item.args))
+	}
+	for _, arg := range item.args {
+		if len(arg) > 0 {
+			bufs = append(bufs, arg)
+		}
+	}
+	return bufs
+}
+
+// copies the args, into b unless they're sealed apart
+func (item *writeItem) merge() {
+	if item.seal {
+		var n int
+		for _, arg := range item.args {
+			n += len(arg)
+		}
+		msg := make([]byte, 0, n)
+		for _, arg := range item.args {
+			msg = append(msg, arg...)
+		}
+		item.args = [][]byte{msg}
+		return
+	}
+
+	for _, arg := range item.args {
+		item.b = append(item.b, arg...)
+	}
+	item.args = nil
+}
+
+type overflow struct {
+	policy     OverflowPolicy
+	timeout    time.Duration
+	key        func(args [][]byte) string
+	onOverflow func(Conn)
+}
+
+func checkOverflow(policy OverflowPolicy, timeout *time.Duration) {
+	if policy == OverflowBlock && *timeout <= 0 {
+		*timeout = time.Second
+		log.Release("invalid OverflowTimeout, reset to %v", *timeout)
+	}
+}
+
+func (o *overflow) msgKey(args [][]byte) string {
+	if o.policy != OverflowCoalesce || o.key == nil {
+		return ""
+	}
+	return o.key(args)
+}
+
+// the write queue of a conn, drained by its writer goroutine
+type writeQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	items   []writeItem
+	max     int
+	closing bool // the close item is queued
+	closed  bool // the conn is destroyed
+	overflow
+}
+
+func newWriteQueue(max int) *writeQueue {
+	q := new(writeQueue)
+	q.cond = sync.NewCond(&q.mu)
+	q.max = max
+	return q
+}
+
+// returns false if the conn should be destroyed
+// onOverflow is called and Block waits without the lock of the queue held
+func (q *writeQueue) push(conn Conn, item writeItem) bool {
+	q.mu.Lock()
+	if q.closing || q.closed {
+		q.mu.Unlock()
+		return true
+	}
+	if len(q.items) < q.max {
+		q.items = append(q.items, item)
+		q.cond.Broadcast()
+		q.mu.Unlock()
+		return true
+	}
+	q.mu.Unlock()
+
+	if q.onOverflow != nil {
+		q.onOverflow(conn)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.policy == OverflowBlock {
+		deadline := time.Now().Add(q.timeout)
+		t := time.AfterFunc(q.timeout, func() {
+			q.mu.Lock()
+			q.cond.Broadcast()
+			q.mu.Unlock()
+		})
+		defer t.Stop()
+		for len(q.items) >= q.max && !q.closing && !q.closed && time.Now().Before(deadline) {
+			q.cond.Wait()
+		}
+	}
+	if q.closing || q.closed {
+		return true
+	}
+	// the writer goroutine has taken some items meanwhile
+	if len(q.items) < q.max {
+		q.items = append(q.items, item)
+		q.cond.Broadcast()
+		return true
+	}
+
+	switch q.policy {
+	case OverflowDropOldest:
+		copy(q.items, q.items[1:])
+		q.items[len(q.items)-1] = item
+		log.Debug("drop oldest message: queue full")
+		return true
+	case OverflowDropNewest:
+		log.Debug("drop newest message: queue full")
+		return true
+	case OverflowBlock:
+		log.Debug("close conn: write timeout")
+		return false
+	case OverflowCoalesce:
+		// the new message takes the place of the old one at the tail,
+		// so it's not written before the messages queued after the old one
+		for i := len(q.items) - 1; item.key != "" && i >= 0; i-- {
+			if q.items[i].key == item.key {
+				copy(q.items[i:], q.items[i+1:])
+				q.items[len(q.items)-1] = item
+				return true
+			}
+		}
+	}
+
+	log.Debug("close conn: queue full")
+	return false
+}
+
+// queues the close item, returns false if the queue is full
+func (q *writeQueue) close() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closing || q.closed {
+		return true
+	}
+	if len(q.items) >= q.max {
+		return false
+	}
+
+	q.items = append(q.items, writeItem{})
+	q.closing = true
+	q.cond.Broadcast()
+	return true
+}
+
+// drops the queued items and wakes up the writers
+func (q *writeQueue) destroy() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.items = nil
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// appends all the queued items to dst, waits if there's none
+// returns false once the queue is destroyed
+func (q *writeQueue) pop(dst []writeItem) ([]writeItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return dst, false
+	}
+
+	dst = append(dst, q.items...)
+	for i := range q.items {
+		q.items[i] = writeItem{}
+	}
+	q.items = q.items[:0]
+	// room for the blocked writers
+	q.cond.Broadcast()
+	return dst, true
+}
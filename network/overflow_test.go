@@ -0,0 +1,121 @@
+package network
+
+import (
+	"testing"
+	"time"
+)
+
+func fullQueue(policy OverflowPolicy, keys ...string) *writeQueue {
+	q := newWriteQueue(len(keys))
+	q.overflow = overflow{policy: policy, timeout: 50 * time.Millisecond}
+	for _, key := range keys {
+		if !q.push(nil, writeItem{b: []byte(key), key: key}) {
+			panic("queue full")
+		}
+	}
+	return q
+}
+
+func queued(q *writeQueue) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var s string
+	for _, item := range q.items {
+		s += string(item.b)
+	}
+	return s
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	q := fullQueue(OverflowDisconnect, "a", "b")
+	overflowed := 0
+	q.onOverflow = func(Conn) { overflowed++ }
+
+	if q.push(nil, writeItem{b: []byte("c")}) {
+		t.Fatal("push to a full queue succeeded")
+	}
+	if overflowed != 1 {
+		t.Fatalf("OnOverflow called %v times", overflowed)
+	}
+	if s := queued(q); s != "ab" {
+		t.Fatalf("queued %q", s)
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	q := fullQueue(OverflowDropOldest, "a", "b")
+	if !q.push(nil, writeItem{b: []byte("c")}) {
+		t.Fatal("push failed")
+	}
+	if s := queued(q); s != "bc" {
+		t.Fatalf("queued %q", s)
+	}
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	q := fullQueue(OverflowDropNewest, "a", "b")
+	if !q.push(nil, writeItem{b: []byte("c")}) {
+		t.Fatal("push failed")
+	}
+	if s := queued(q); s != "ab" {
+		t.Fatalf("queued %q", s)
+	}
+}
+
+func TestOverflowBlock(t *testing.T) {
+	q := fullQueue(OverflowBlock, "a", "b")
+	q.timeout = 5 * time.Second
+
+	// room is made while the writer waits
+	popped := make(chan string)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		items, _ := q.pop(nil)
+		popped <- string(items[0].b) + string(items[1].b)
+	}()
+	if !q.push(nil, writeItem{b: []byte("c")}) {
+		t.Fatal("push failed")
+	}
+	if s := <-popped; s != "ab" {
+		t.Fatalf("popped %q", s)
+	}
+	if s := queued(q); s != "c" {
+		t.Fatalf("queued %q", s)
+	}
+
+	// no room within the timeout
+	q = fullQueue(OverflowBlock, "a", "b")
+	start := time.Now()
+	if q.push(nil, writeItem{b: []byte("c")}) {
+		t.Fatal("push to a full queue succeeded")
+	}
+	if d := time.Since(start); d < q.timeout {
+		t.Fatalf("push returned after %v", d)
+	}
+
+	// the conn is destroyed while the writer waits
+	q = fullQueue(OverflowBlock, "a", "b")
+	q.timeout = 5 * time.Second
+	time.AfterFunc(20*time.Millisecond, q.destroy)
+	if !q.push(nil, writeItem{b: []byte("c")}) {
+		t.Fatal("push to a destroyed queue failed")
+	}
+}
+
+func TestOverflowCoalesce(t *testing.T) {
+	q := fullQueue(OverflowCoalesce, "a", "b", "a", "c")
+	if !q.push(nil, writeItem{b: []byte("A"), key: "a"}) {
+		t.Fatal("push failed")
+	}
+	// the latest a is replaced and the new one is written last
+	if s := queued(q); s != "abcA" {
+		t.Fatalf("queued %q", s)
+	}
+
+	if q.push(nil, writeItem{b: []byte("d"), key: "d"}) {
+		t.Fatal("push of a new key to a full queue succeeded")
+	}
+	if q.push(nil, writeItem{b: []byte("e")}) {
+		t.Fatal("push without a key to a full queue succeeded")
+	}
+}
@@ -1,10 +1,106 @@
 package network
 
+import (
+	"errors"
+	"fmt"
+	"github.com/name5566/leaf/conf"
+	"github.com/name5566/leaf/log"
+	"runtime"
+)
+
 type Processor interface {
 	// must goroutine safe
 	Route(msg interface{}, userData interface{}) error
 	// must goroutine safe
+	// data may be a pooled buffer, the message returned must not refer to it
 	Unmarshal(data []byte) (interface{}, error)
 	// must goroutine safe
 	Marshal(msg interface{}) ([][]byte, error)
 }
+
+// TextProcessor is implemented by the processors of text messages, such as
+// json, their messages are written in websocket text frames
+type TextProcessor interface {
+	TextMessage() bool
+}
+
+// Request is a message with a request id, it's returned by Unmarshal and
+// taken by Marshal once the processor enables request ids. id zero means
+// the message is not a request, an error as Msg is an error reply
+type Request struct {
+	ID  uint32
+	Msg interface{}
+}
+
+// Replier replies to a request, the agents are repliers
+// id zero writes msg as is, an error as msg is written as an error reply
+type Replier interface {
+	Reply(id uint32, msg interface{})
+}
+
+// MsgReqHandler handles a request, the arguments are the message, userData
+// and the request id, the returned message or error is the reply
+type MsgReqHandler func([]interface{}) (interface{}, error)
+
+// ReplyError is an error replied to the client as is, the other errors
+// returned by a MsgReqHandler are logged and replied as ErrInternal
+type ReplyError string
+
+func (e ReplyError) Error() string {
+	return string(e)
+}
+
+// ErrInternal replaces the errors and the panics of the request handlers
+var ErrInternal ReplyError = "internal error"
+
+// HandleRequest calls h with args and replies the result to args[1] if it's
+// a Replier and args[2] isn't zero, goroutine safe
+func HandleRequest(h MsgReqHandler, args []interface{}) {
+	msg, userData, id := args[0], args[1], args[2].(uint32)
+	ret, err := call(h, args)
+	if err != nil {
+		var replyErr ReplyError
+		if !errors.As(err, &replyErr) {
+			log.Error("message %T error: %v", msg, err)
+			replyErr = ErrInternal
+		}
+		err = replyErr
+	}
+
+	r, ok := userData.(Replier)
+	if !ok || id == 0 {
+		if err != nil && err != ErrInternal {
+			log.Debug("message %T error: %v", msg, err)
+		}
+		return
+	}
+	if err != nil {
+		r.Reply(id, err)
+	} else if ret != nil {
+		r.Reply(id, ret)
+	}
+}
+
+// RequestFunc makes h a function of chanrpc.Server, so a routed request
+// is handled and replied by the module
+func RequestFunc(h MsgReqHandler) func([]interface{}) {
+	return func(args []interface{}) {
+		HandleRequest(h, args)
+	}
+}
+
+func call(h MsgReqHandler, args []interface{}) (ret interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if conf.LenStackBuf > 0 {
+				buf := make([]byte, conf.LenStackBuf)
+				l := runtime.Stack(buf, false)
+				err = fmt.Errorf("%v: %s", r, buf[:l])
+			} else {
+				err = fmt.Errorf("%v", r)
+			}
+		}
+	}()
+
+	return h(args)
+}
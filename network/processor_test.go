@@ -0,0 +1,51 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+type replies map[uint32]interface{}
+
+func (r replies) Reply(id uint32, msg interface{}) {
+	r[id] = msg
+}
+
+func TestHandleRequest(t *testing.T) {
+	h := func(args []interface{}) (interface{}, error) {
+		switch args[0].(string) {
+		case "ok":
+			return "done", nil
+		case "reply error":
+			return nil, fmt.Errorf("login: %w", ReplyError("bad password"))
+		case "error":
+			return nil, errors.New("db: connection refused")
+		}
+		panic("bug")
+	}
+
+	r := make(replies)
+	for id, msg := range []string{"ok", "reply error", "error", "panic"} {
+		HandleRequest(h, []interface{}{msg, r, uint32(id + 1)})
+	}
+	want := replies{
+		1: "done",
+		2: ReplyError("bad password"),
+		3: ErrInternal,
+		4: ErrInternal,
+	}
+	for id, msg := range want {
+		if r[id] != msg {
+			t.Fatalf("reply %v: %v, want %v", id, r[id], msg)
+		}
+	}
+
+	// not a request
+	r = make(replies)
+	HandleRequest(h, []interface{}{"ok", r, uint32(0)})
+	RequestFunc(h)([]interface{}{"panic", nil, uint32(1)})
+	if len(r) != 0 {
+		t.Fatalf("replied %v", r)
+	}
+}
@@ -0,0 +1,52 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+	"text/template"
+)
+
+// MsgID is a row of the id table shared with the clients
+type MsgID struct {
+	ID   uint16 `json:"id"`
+	Name string `json:"name"` // full name of the protobuf message
+}
+
+// goroutine safe
+// in the order of ids
+func (p *Processor) IDTable() []MsgID {
+	ids := p.ids()
+	table := make([]MsgID, 0, len(ids))
+	for _, id := range ids {
+		table = append(table, MsgID{ID: id, Name: string(p.msgInfo[id].msgName)})
+	}
+	return table
+}
+
+// ExportJSON writes the id table as a json array, for example
+// [{"id":1,"name":"leaf.Hello"}]
+func (p *Processor) ExportJSON(w io.Writer) error {
+	return json.NewEncoder(w).Encode(p.IDTable())
+}
+
+// CodeFuncs are the functions for the templates of ExportCode
+// ident turns a full name into an identifier, "leaf.Hello" into "leaf_Hello"
+var CodeFuncs = template.FuncMap{
+	"ident": func(name string) string {
+		return strings.ReplaceAll(name, ".", "_")
+	},
+}
+
+// ExportCode executes tmpl with the id table ([]MsgID) to generate client code,
+// for example a typescript enum:
+//
+//	tmpl := template.Must(template.New("id").Funcs(protobuf.CodeFuncs).Parse(`export enum MsgID {
+//	{{- range .}}
+//		{{ident .Name}} = {{.ID}},
+//	{{- end}}
+//	}
+//	`))
+func (p *Processor) ExportCode(w io.Writer, tmpl *template.Template) error {
+	return tmpl.Execute(w, p.IDTable())
+}
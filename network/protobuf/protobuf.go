@@ -4,27 +4,55 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"github.com/golang/protobuf/proto"
 	"github.com/name5566/leaf/chanrpc"
 	"github.com/name5566/leaf/log"
+	"github.com/name5566/leaf/network"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/runtime/protoiface"
+	"google.golang.org/protobuf/runtime/protoimpl"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"hash/fnv"
 	"math"
 	"reflect"
+	"sort"
 )
 
 // -------------------------
 // | id | protobuf message |
 // -------------------------
+// with request ids:
+// --------------------------------------
+// | id | request id | protobuf message |
+// --------------------------------------
+// the request id is a uint32, an error reply has the id errorID and
+// the error text instead of the message
+//
+// messages are known by the full names of their descriptors, so dynamicpb
+// messages work the same as the generated ones, the id of a router is the
+// reflect.Type of a generated message or the protoreflect.FullName of a
+// dynamic one. The messages taken are protoiface.MessageV1, the messages of
+// both the old github.com/golang/protobuf and google.golang.org/protobuf,
+// a message must be of the registered type, not only of the same name
 type Processor struct {
 	littleEndian bool
-	msgInfo      []*MsgInfo
-	msgID        map[reflect.Type]uint16
+	requestID    bool
+	msgInfo      map[uint16]*MsgInfo
+	msgID        map[protoreflect.FullName]uint16
+	nextID       uint16 // the id of the next Register
 }
 
+const errorID = math.MaxUint16
+
 type MsgInfo struct {
-	msgType       reflect.Type
+	msgType       protoreflect.MessageType
+	msgName       protoreflect.FullName
+	routerID      interface{}
 	msgRouter     *chanrpc.Server
 	msgHandler    MsgHandler
 	msgRawHandler MsgHandler
+	msgReqHandler network.MsgReqHandler
 }
 
 type MsgHandler func([]interface{})
@@ -37,7 +65,8 @@ type MsgRaw struct {
 func NewProcessor() *Processor {
 	p := new(Processor)
 	p.littleEndian = false
-	p.msgID = make(map[reflect.Type]uint16)
+	p.msgInfo = make(map[uint16]*MsgInfo)
+	p.msgID = make(map[protoreflect.FullName]uint16)
 	return p
 }
 
@@ -47,83 +76,196 @@ func (p *Processor) SetByteOrder(littleEndian bool) {
 }
 
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
-func (p *Processor) Register(msg proto.Message) uint16 {
-	msgType := reflect.TypeOf(msg)
-	if msgType == nil || msgType.Kind() != reflect.Ptr {
-		log.Fatal("protobuf message pointer required")
+func (p *Processor) SetRequestID(enable bool) {
+	p.requestID = enable
+}
+
+// Register takes the ids 0, 1, 2... in the order of its calls, regardless
+// of the other ways of registering, so the ids change when the calls are
+// reordered, use RegisterWithID or RegisterWithHash for stable ids and keep
+// them out of the range taken by Register
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) Register(msg protoiface.MessageV1) uint16 {
+	id := p.nextID
+	p.register(id, msg)
+	p.nextID++
+	return id
+}
+
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterWithID(id uint16, msg protoiface.MessageV1) {
+	p.register(id, msg)
+}
+
+// RegisterWithHash takes an id derived from the full name of the message,
+// for example "leaf.Hello", a collision is fatal and must be resolved by
+// RegisterWithID. The ids are 16 bits, with n messages the odds of any
+// collision are 1-exp(-n*n/131072), 10% at 120 messages and 50% at 300, so
+// it suits small protocols best
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterWithHash(msg protoiface.MessageV1) uint16 {
+	if msg == nil {
+		log.Fatal("protobuf message required")
 	}
-	if _, ok := p.msgID[msgType]; ok {
-		log.Fatal("message %s is already registered", msgType)
+	id := HashID(string(protoimpl.X.ProtoMessageV2Of(msg).ProtoReflect().Descriptor().FullName()))
+	p.register(id, msg)
+	return id
+}
+
+// RegisterByName registers the message of name in protoregistry.GlobalTypes
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) RegisterByName(name string) uint16 {
+	msgType, err := protoregistry.GlobalTypes.FindMessageByName(protoreflect.FullName(name))
+	if err != nil {
+		log.Fatal("message %v: %v", name, err)
 	}
-	if len(p.msgInfo) >= math.MaxUint16 {
-		log.Fatal("too many protobuf messages (max = %v)", math.MaxUint16)
+	return p.Register(protoimpl.X.ProtoMessageV1Of(msgType.Zero().Interface()))
+}
+
+// HashID is the fnv-1a hash of name folded to 16 bits, errorID excluded
+func HashID(name string) uint16 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	sum := h.Sum32()
+	id := uint16(sum>>16) ^ uint16(sum)
+	if id == errorID {
+		id = 0
+	}
+	return id
+}
+
+func (p *Processor) register(id uint16, msg protoiface.MessageV1) {
+	if msg == nil {
+		log.Fatal("protobuf message required")
+	}
+	msgType := protoimpl.X.ProtoMessageV2Of(msg).ProtoReflect().Type()
+	msgName := msgType.Descriptor().FullName()
+	if _, ok := p.msgID[msgName]; ok {
+		log.Fatal("message %v is already registered", msgName)
+	}
+	if id == errorID {
+		log.Fatal("message id %v is reserved", id)
+	}
+	if i, ok := p.msgInfo[id]; ok {
+		log.Fatal("message id %v of %v is already taken by %v", id, msgName, i.msgName)
 	}
 
 	i := new(MsgInfo)
 	i.msgType = msgType
-	p.msgInfo = append(p.msgInfo, i)
-	id := uint16(len(p.msgInfo) - 1)
-	p.msgID[msgType] = id
-	return id
+	i.msgName = msgName
+	if _, ok := msgType.Zero().Interface().(*dynamicpb.Message); ok {
+		i.routerID = msgName
+	} else {
+		i.routerID = reflect.TypeOf(msg)
+	}
+	p.msgInfo[id] = i
+	p.msgID[msgName] = id
 }
 
-// It's dangerous to call the method on routing or marshaling (unmarshaling)
-func (p *Processor) SetRouter(msg proto.Message, msgRouter *chanrpc.Server) {
-	msgType := reflect.TypeOf(msg)
-	id, ok := p.msgID[msgType]
+// the registered info of msg, a protoiface.MessageV1 or a proto.Message
+func (p *Processor) info(msg interface{}) (*MsgInfo, error) {
+	var m proto.Message
+	switch msg := msg.(type) {
+	case proto.Message:
+		m = msg
+	case protoiface.MessageV1:
+		m = protoimpl.X.ProtoMessageV2Of(msg)
+	case nil:
+		return nil, errors.New("protobuf message required")
+	default:
+		return nil, fmt.Errorf("message %T is not a protobuf message", msg)
+	}
+
+	msgType := m.ProtoReflect().Type()
+	msgName := msgType.Descriptor().FullName()
+	id, ok := p.msgID[msgName]
 	if !ok {
-		log.Fatal("message %s not registered", msgType)
+		return nil, fmt.Errorf("message %v not registered", msgName)
+	}
+	i := p.msgInfo[id]
+	if msgType != i.msgType {
+		return nil, fmt.Errorf("message %T is not of the registered type of %v", msg, msgName)
+	}
+	return i, nil
+}
+
+// a request is routed with its id, register the function of the router
+// by network.RequestFunc to reply to it
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetRouter(msg protoiface.MessageV1, msgRouter *chanrpc.Server) {
+	i, err := p.info(msg)
+	if err != nil {
+		log.Fatal("%v", err)
 	}
 
-	p.msgInfo[id].msgRouter = msgRouter
+	i.msgRouter = msgRouter
 }
 
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
-func (p *Processor) SetHandler(msg proto.Message, msgHandler MsgHandler) {
-	msgType := reflect.TypeOf(msg)
-	id, ok := p.msgID[msgType]
-	if !ok {
-		log.Fatal("message %s not registered", msgType)
+func (p *Processor) SetHandler(msg protoiface.MessageV1, msgHandler MsgHandler) {
+	i, err := p.info(msg)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	i.msgHandler = msgHandler
+}
+
+// the handler runs on the goroutine of the agent, see network.HandleRequest
+// It's dangerous to call the method on routing or marshaling (unmarshaling)
+func (p *Processor) SetRequestHandler(msg protoiface.MessageV1, msgReqHandler network.MsgReqHandler) {
+	i, err := p.info(msg)
+	if err != nil {
+		log.Fatal("%v", err)
 	}
 
-	p.msgInfo[id].msgHandler = msgHandler
+	i.msgReqHandler = msgReqHandler
 }
 
 // It's dangerous to call the method on routing or marshaling (unmarshaling)
 func (p *Processor) SetRawHandler(id uint16, msgRawHandler MsgHandler) {
-	if id >= uint16(len(p.msgInfo)) {
+	i, ok := p.msgInfo[id]
+	if !ok {
 		log.Fatal("message id %v not registered", id)
 	}
 
-	p.msgInfo[id].msgRawHandler = msgRawHandler
+	i.msgRawHandler = msgRawHandler
 }
 
 // goroutine safe
+// the handlers get the request id after userData, zero if it's not a request
 func (p *Processor) Route(msg interface{}, userData interface{}) error {
+	// request
+	var reqID uint32
+	if req, ok := msg.(*network.Request); ok {
+		reqID, msg = req.ID, req.Msg
+	}
+
 	// raw
 	if msgRaw, ok := msg.(MsgRaw); ok {
-		if msgRaw.msgID >= uint16(len(p.msgInfo)) {
+		i, ok := p.msgInfo[msgRaw.msgID]
+		if !ok {
 			return fmt.Errorf("message id %v not registered", msgRaw.msgID)
 		}
-		i := p.msgInfo[msgRaw.msgID]
 		if i.msgRawHandler != nil {
-			i.msgRawHandler([]interface{}{msgRaw.msgID, msgRaw.msgRawData, userData})
+			i.msgRawHandler([]interface{}{msgRaw.msgID, msgRaw.msgRawData, userData, reqID})
 		}
 		return nil
 	}
 
 	// protobuf
-	msgType := reflect.TypeOf(msg)
-	id, ok := p.msgID[msgType]
-	if !ok {
-		return fmt.Errorf("message %s not registered", msgType)
+	i, err := p.info(msg)
+	if err != nil {
+		return err
 	}
-	i := p.msgInfo[id]
 	if i.msgHandler != nil {
-		i.msgHandler([]interface{}{msg, userData})
+		i.msgHandler([]interface{}{msg, userData, reqID})
+	}
+	if i.msgReqHandler != nil {
+		network.HandleRequest(i.msgReqHandler, []interface{}{msg, userData, reqID})
 	}
 	if i.msgRouter != nil {
-		i.msgRouter.Go(msgType, msg, userData)
+		i.msgRouter.Go(i.routerID, msg, userData, reqID)
 	}
 	return nil
 }
@@ -141,46 +283,119 @@ func (p *Processor) Unmarshal(data []byte) (interface{}, error) {
 	} else {
 		id = binary.BigEndian.Uint16(data)
 	}
-	if id >= uint16(len(p.msgInfo)) {
+
+	// request
+	if p.requestID {
+		if len(data) < 6 {
+			return nil, errors.New("protobuf data too short")
+		}
+		var reqID uint32
+		if p.littleEndian {
+			reqID = binary.LittleEndian.Uint32(data[2:])
+		} else {
+			reqID = binary.BigEndian.Uint32(data[2:])
+		}
+		if id == errorID {
+			return &network.Request{ID: reqID, Msg: errors.New(string(data[6:]))}, nil
+		}
+
+		msg, err := p.unmarshal(id, data[6:])
+		if err != nil {
+			return nil, err
+		}
+		return &network.Request{ID: reqID, Msg: msg}, nil
+	}
+
+	return p.unmarshal(id, data[2:])
+}
+
+func (p *Processor) unmarshal(id uint16, data []byte) (interface{}, error) {
+	i, ok := p.msgInfo[id]
+	if !ok {
 		return nil, fmt.Errorf("message id %v not registered", id)
 	}
 
 	// msg
-	i := p.msgInfo[id]
 	if i.msgRawHandler != nil {
-		return MsgRaw{id, data[2:]}, nil
+		// data may be a pooled buffer, the handler may keep the copy
+		return MsgRaw{id, append([]byte(nil), data...)}, nil
 	} else {
-		msg := reflect.New(i.msgType.Elem()).Interface()
-		return msg, proto.UnmarshalMerge(data[2:], msg.(proto.Message))
+		msg := i.msgType.New().Interface()
+		return protoimpl.X.ProtoMessageV1Of(msg), proto.Unmarshal(data, msg)
 	}
 }
 
 // goroutine safe
 func (p *Processor) Marshal(msg interface{}) ([][]byte, error) {
-	msgType := reflect.TypeOf(msg)
+	// request
+	var reqID uint32
+	if req, ok := msg.(*network.Request); ok {
+		if !p.requestID {
+			return nil, errors.New("request id not enabled")
+		}
+		reqID, msg = req.ID, req.Msg
+	}
+	if err, ok := msg.(error); ok && p.requestID {
+		return [][]byte{p.header(errorID, reqID), []byte(err.Error())}, nil
+	}
 
 	// id
-	_id, ok := p.msgID[msgType]
-	if !ok {
-		err := fmt.Errorf("message %s not registered", msgType)
+	i, err := p.info(msg)
+	if err != nil {
 		return nil, err
 	}
+	id := p.header(p.msgID[i.msgName], reqID)
+
+	// data
+	data, err := proto.Marshal(protoimpl.X.ProtoMessageV2Of(msg))
+	return [][]byte{id, data}, err
+}
+
+// the id and the request id
+func (p *Processor) header(id uint16, reqID uint32) []byte {
+	n := 2
+	if p.requestID {
+		n = 6
+	}
 
-	id := make([]byte, 2)
+	b := make([]byte, n)
 	if p.littleEndian {
-		binary.LittleEndian.PutUint16(id, _id)
+		binary.LittleEndian.PutUint16(b, id)
+		if p.requestID {
+			binary.LittleEndian.PutUint32(b[2:], reqID)
+		}
 	} else {
-		binary.BigEndian.PutUint16(id, _id)
+		binary.BigEndian.PutUint16(b, id)
+		if p.requestID {
+			binary.BigEndian.PutUint32(b[2:], reqID)
+		}
 	}
-
-	// data
-	data, err := proto.Marshal(msg.(proto.Message))
-	return [][]byte{id, data}, err
+	return b
 }
 
 // goroutine safe
+// in the order of ids
 func (p *Processor) Range(f func(id uint16, t reflect.Type)) {
-	for id, i := range p.msgInfo {
-		f(uint16(id), i.msgType)
+	for _, id := range p.ids() {
+		f(id, reflect.TypeOf(protoimpl.X.ProtoMessageV1Of(p.msgInfo[id].msgType.Zero().Interface())))
+	}
+}
+
+// goroutine safe
+// in the order of ids, the types of dynamic messages are dynamicpb types
+func (p *Processor) RangeTypes(f func(id uint16, t protoreflect.MessageType)) {
+	for _, id := range p.ids() {
+		f(id, p.msgInfo[id].msgType)
+	}
+}
+
+func (p *Processor) ids() []uint16 {
+	ids := make([]uint16, 0, len(p.msgInfo))
+	for id := range p.msgInfo {
+		ids = append(ids, id)
 	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
 }
@@ -0,0 +1,225 @@
+package protobuf
+
+import (
+	"bytes"
+	"github.com/name5566/leaf/chanrpc"
+	"github.com/name5566/leaf/network"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+	"os"
+	"reflect"
+	"testing"
+	"text/template"
+)
+
+func marshal(t *testing.T, p *Processor, msg interface{}) []byte {
+	data, err := p.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Join(data, nil)
+}
+
+// the data given to Unmarshal may be a pooled buffer reused later
+func TestRawHandlerCopy(t *testing.T) {
+	p := NewProcessor()
+	id := p.Register(&wrapperspb.StringValue{})
+	var kept []byte
+	p.SetRawHandler(id, func(args []interface{}) {
+		kept = args[1].([]byte)
+	})
+
+	data := marshal(t, p, wrapperspb.String("leaf"))
+	msg, err := p.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Route(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := range data {
+		data[i] = 0
+	}
+
+	var s wrapperspb.StringValue
+	if err := proto.Unmarshal(kept, &s); err != nil || s.Value != "leaf" {
+		t.Fatalf("raw data changed with the buffer: %v %q", err, s.Value)
+	}
+}
+
+func TestMarshalRequest(t *testing.T) {
+	p := NewProcessor()
+	p.RegisterWithID(1, &wrapperspb.StringValue{})
+	if _, err := p.Marshal(&network.Request{ID: 7, Msg: wrapperspb.String("leaf")}); err == nil {
+		t.Fatal("request marshaled without request ids")
+	}
+
+	// | id | message |
+	data := marshal(t, p, wrapperspb.String("leaf"))
+	if !bytes.Equal(data[:2], []byte{0, 1}) {
+		t.Fatalf("header % x", data[:2])
+	}
+	msg, err := p.Unmarshal(data)
+	if err != nil || !proto.Equal(msg.(proto.Message), wrapperspb.String("leaf")) {
+		t.Fatalf("unmarshaled %v %v", msg, err)
+	}
+
+	// | id | request id | message |
+	p.SetRequestID(true)
+	data = marshal(t, p, &network.Request{ID: 7, Msg: wrapperspb.String("leaf")})
+	if !bytes.Equal(data[:6], []byte{0, 1, 0, 0, 0, 7}) {
+		t.Fatalf("header % x", data[:6])
+	}
+	msg, err = p.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := msg.(*network.Request)
+	if req.ID != 7 || !proto.Equal(req.Msg.(proto.Message), wrapperspb.String("leaf")) {
+		t.Fatalf("unmarshaled %v %v", req.ID, req.Msg)
+	}
+
+	// | errorID | request id | error text |
+	data = marshal(t, p, &network.Request{ID: 7, Msg: network.ReplyError("bad name")})
+	if !bytes.Equal(data, []byte("\xff\xff\x00\x00\x00\x07bad name")) {
+		t.Fatalf("error reply % x", data)
+	}
+	msg, err = p.Unmarshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = msg.(*network.Request)
+	if req.ID != 7 || req.Msg.(error).Error() != "bad name" {
+		t.Fatalf("unmarshaled %v %v", req.ID, req.Msg)
+	}
+}
+
+// the ids are shared with the clients and must never change
+func TestHashID(t *testing.T) {
+	for name, id := range map[string]uint16{
+		"leaf.Hello":                  10572,
+		"leaf.Login":                  3343,
+		"google.protobuf.StringValue": 62410,
+	} {
+		if HashID(name) != id {
+			t.Fatalf("HashID(%q) = %v, want %v", name, HashID(name), id)
+		}
+	}
+}
+
+func TestRegisterID(t *testing.T) {
+	p := NewProcessor()
+	p.RegisterWithID(100, &wrapperspb.Int32Value{})
+	if id := p.Register(&wrapperspb.StringValue{}); id != 0 {
+		t.Fatalf("Register id %v", id)
+	}
+	if id := p.RegisterWithHash(&wrapperspb.BoolValue{}); id != HashID("google.protobuf.BoolValue") {
+		t.Fatalf("RegisterWithHash id %v", id)
+	}
+	// the ids of Register depend on its calls only
+	if id := p.Register(&wrapperspb.BytesValue{}); id != 1 {
+		t.Fatalf("Register id %v", id)
+	}
+}
+
+func ExampleProcessor_ExportJSON() {
+	p := NewProcessor()
+	p.RegisterWithID(2, &wrapperspb.StringValue{})
+	p.RegisterWithID(1, &wrapperspb.Int32Value{})
+	p.ExportJSON(os.Stdout)
+
+	// Output:
+	// [{"id":1,"name":"google.protobuf.Int32Value"},{"id":2,"name":"google.protobuf.StringValue"}]
+}
+
+func ExampleProcessor_ExportCode() {
+	p := NewProcessor()
+	p.RegisterWithID(2, &wrapperspb.StringValue{})
+	p.RegisterWithID(1, &wrapperspb.Int32Value{})
+
+	tmpl := template.Must(template.New("id").Funcs(CodeFuncs).Parse(`export enum MsgID {
+{{- range .}}
+	{{ident .Name}} = {{.ID}},
+{{- end}}
+}
+`))
+	p.ExportCode(os.Stdout, tmpl)
+
+	// Output:
+	// export enum MsgID {
+	// 	google_protobuf_Int32Value = 1,
+	// 	google_protobuf_StringValue = 2,
+	// }
+}
+
+// a message of the old github.com/golang/protobuf, without ProtoReflect
+type legacyHello struct {
+	Name string `protobuf:"bytes,1,opt,name=name,proto3"`
+}
+
+func (m *legacyHello) Reset()         { *m = legacyHello{} }
+func (m *legacyHello) String() string { return m.Name }
+func (*legacyHello) ProtoMessage()    {}
+
+func TestMessageV1(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&legacyHello{})
+	var got interface{}
+	p.SetHandler(&legacyHello{}, func(args []interface{}) {
+		got = args[0]
+	})
+
+	msg, err := p.Unmarshal(marshal(t, p, &legacyHello{Name: "leaf"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Route(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	if m, ok := got.(*legacyHello); !ok || m.Name != "leaf" {
+		t.Fatalf("routed %#v", got)
+	}
+	p.Range(func(id uint16, typ reflect.Type) {
+		if typ != reflect.TypeOf(&legacyHello{}) {
+			t.Fatalf("range type %v", typ)
+		}
+	})
+}
+
+func TestDynamicMessage(t *testing.T) {
+	p := NewProcessor()
+	p.Register(&wrapperspb.StringValue{})
+	int32Type := dynamicpb.NewMessageType((&wrapperspb.Int32Value{}).ProtoReflect().Descriptor())
+	p.Register(int32Type.New().Interface().(*dynamicpb.Message))
+
+	// a dynamic message of the registered name but not of the registered type
+	str := dynamicpb.NewMessageType((&wrapperspb.StringValue{}).ProtoReflect().Descriptor()).New()
+	str.Set(str.Descriptor().Fields().ByName("value"), protoreflect.ValueOfString("leaf"))
+	if _, err := p.Marshal(str.Interface()); err == nil {
+		t.Fatal("dynamic message marshaled as the generated one")
+	}
+	if err := p.Route(str.Interface(), nil); err == nil {
+		t.Fatal("dynamic message routed as the generated one")
+	}
+
+	// a registered dynamic message is routed by its full name
+	router := chanrpc.NewServer(1)
+	router.Register(int32Type.Descriptor().FullName(), func(args []interface{}) {})
+	p.SetRouter(int32Type.Zero().Interface().(*dynamicpb.Message), router)
+	n := int32Type.New()
+	n.Set(n.Descriptor().Fields().ByName("value"), protoreflect.ValueOfInt32(7))
+	msg, err := p.Unmarshal(marshal(t, p, n.Interface()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Route(msg, nil); err != nil {
+		t.Fatal(err)
+	}
+	ci := <-router.ChanCall
+	router.Exec(ci)
+	if m, ok := msg.(*dynamicpb.Message); !ok || !proto.Equal(m, n.Interface()) {
+		t.Fatalf("unmarshaled %v", msg)
+	}
+}
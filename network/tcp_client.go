@@ -1,19 +1,29 @@
 package network
 
 import (
+	"crypto/tls"
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
 	"time"
 )
 
+// Addr may be a unix domain socket, for example "unix:/tmp/leaf.sock"
 type TCPClient struct {
 	sync.Mutex
 	Addr            string
 	ConnNum         int
 	ConnectInterval time.Duration
 	PendingWriteNum int
+	FirstMsgTimeout time.Duration
+	IdleTimeout     time.Duration
+	KeepAlive       time.Duration
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceKey     func(args [][]byte) string
+	OnOverflow      func(Conn)
 	AutoReconnect   bool
+	DialTimeout     time.Duration // tls handshake included, 10s if zero
 	NewAgent        func(*TCPConn) Agent
 	conns           ConnSet
 	wg              sync.WaitGroup
@@ -24,7 +34,26 @@ type TCPClient struct {
 	MinMsgLen    uint32
 	MaxMsgLen    uint32
 	LittleEndian bool
+	BufferPool   bool
+	FrameCodec   FrameCodec // replaces LenMsgLen and LittleEndian if not nil
 	msgParser    *MsgParser
+
+	// compression, messages of CompressThreshold bytes or more are compressed,
+	// zero disables it, the peer must enable compression too, see compress.go
+	CompressThreshold int
+
+	// tls, enabled by TLS or any of the files or ServerName
+	// CertFile and KeyFile are the client certificate for mutual tls,
+	// CAFile verifies the server certificate, the system roots are used if empty
+	TLS        bool
+	CertFile   string
+	KeyFile    string
+	CAFile     string
+	ServerName string      // the host of Addr if empty
+	TLSConfig  *tls.Config // used instead of the above if not nil
+
+	// session encryption, the server must enable it too, see cipher.go
+	Encrypt bool
 }
 
 func (client *TCPClient) Start() {
@@ -52,6 +81,7 @@ func (client *TCPClient) init() {
 		client.PendingWriteNum = 100
 		log.Release("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
 	}
+	checkOverflow(client.OverflowPolicy, &client.OverflowTimeout)
 	if client.NewAgent == nil {
 		log.Fatal("NewAgent must not be nil")
 	}
@@ -59,22 +89,50 @@ func (client *TCPClient) init() {
 		log.Fatal("client is running")
 	}
 
+	if client.DialTimeout <= 0 {
+		client.DialTimeout = 10 * time.Second
+	}
+	tlsFiles := client.CertFile != "" || client.KeyFile != "" || client.CAFile != "" || client.ServerName != ""
+	if client.TLSConfig == nil && (client.TLS || tlsFiles) {
+		config, err := newTLSConfig(client.CertFile, client.KeyFile, client.CAFile, false)
+		if err != nil {
+			log.Fatal("%v", err)
+		}
+		config.ServerName = client.ServerName
+		client.TLSConfig = config
+	}
+
 	client.conns = make(ConnSet)
 	client.closeFlag = false
 
 	// msg parser
 	msgParser := NewMsgParser()
+	msgParser.SetFrameCodec(client.FrameCodec)
 	msgParser.SetMsgLen(client.LenMsgLen, client.MinMsgLen, client.MaxMsgLen)
 	msgParser.SetByteOrder(client.LittleEndian)
+	msgParser.SetBufferPool(client.BufferPool)
+	msgParser.SetCompression(client.CompressThreshold)
 	client.msgParser = msgParser
 }
 
 func (client *TCPClient) dial() net.Conn {
 	for {
-		conn, err := net.Dial("tcp", client.Addr)
-		if err == nil || client.closeFlag {
+		dialer := net.Dialer{Timeout: client.DialTimeout, KeepAlive: client.KeepAlive}
+		var conn net.Conn
+		var err error
+		network, address := splitAddr(client.Addr)
+		if client.TLSConfig != nil {
+			conn, err = tls.DialWithDialer(&dialer, network, address, client.TLSConfig)
+		} else {
+			conn, err = dialer.Dial(network, address)
+		}
+		if err == nil {
 			return conn
 		}
+		if client.closed() {
+			// a failed tls dial returns a nil *tls.Conn
+			return nil
+		}
 
 		log.Release("connect to %v error: %v", client.Addr, err)
 		time.Sleep(client.ConnectInterval)
@@ -82,6 +140,12 @@ func (client *TCPClient) dial() net.Conn {
 	}
 }
 
+func (client *TCPClient) closed() bool {
+	client.Lock()
+	defer client.Unlock()
+	return client.closeFlag
+}
+
 func (client *TCPClient) connect() {
 	defer client.wg.Done()
 
@@ -101,22 +165,56 @@ reconnect:
 	client.Unlock()
 
 	tcpConn := newTCPConn(conn, client.PendingWriteNum, client.msgParser)
-	agent := client.NewAgent(tcpConn)
-	agent.Run()
+	tcpConn.setReadTimeout(client.FirstMsgTimeout, client.IdleTimeout)
+	tcpConn.setOverflow(client.OverflowPolicy, client.OverflowTimeout, client.CoalesceKey, client.OnOverflow)
+	var agent Agent
+	if client.handshake(tcpConn) {
+		agent = client.NewAgent(tcpConn)
+		agent.Run()
+	}
 
 	// cleanup
 	tcpConn.Close()
 	client.Lock()
 	delete(client.conns, conn)
 	client.Unlock()
-	agent.OnClose()
+	if agent != nil {
+		agent.OnClose()
+	}
 
 	if client.AutoReconnect {
+		client.Lock()
+		closeFlag := client.closeFlag
+		client.Unlock()
+		if closeFlag {
+			return
+		}
+
 		time.Sleep(client.ConnectInterval)
 		goto reconnect
 	}
 }
 
+func (client *TCPClient) handshake(tcpConn *TCPConn) bool {
+	if client.CompressThreshold > 0 {
+		err := tcpConn.compressHandshake(false)
+		if err != nil {
+			log.Release("compression handshake with %v error: %v", client.Addr, err)
+			return false
+		}
+	}
+	if !client.Encrypt {
+		return true
+	}
+
+	err := tcpConn.handshake(false)
+	if err != nil {
+		log.Release("handshake with %v error: %v", client.Addr, err)
+		return false
+	}
+	return true
+}
+
 func (client *TCPClient) Close() {
 	client.Lock()
 	client.closeFlag = true
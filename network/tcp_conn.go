@@ -1,40 +1,100 @@
 package network
 
 import (
+	"bufio"
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type ConnSet map[net.Conn]struct{}
 
+// the merged batch buffer larger than that is not kept for the next batch
+const maxMergedLen = 64 * 1024
+
 type TCPConn struct {
 	sync.Mutex
 	conn      net.Conn
-	writeChan chan []byte
+	reader    *bufio.Reader
+	queue     *writeQueue
 	closeFlag bool
 	msgParser *MsgParser
+	timeout   readTimeout
+	readBuf   *[]byte // borrowed by the last message read
+	cipher    *sessionCipher
+	writes    atomic.Uint64 // batches written to conn
 }
 
 func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPConn {
 	tcpConn := new(TCPConn)
 	tcpConn.conn = conn
-	tcpConn.writeChan = make(chan []byte, pendingWriteNum)
+	tcpConn.reader = bufio.NewReader(conn)
+	tcpConn.queue = newWriteQueue(pendingWriteNum)
 	tcpConn.msgParser = msgParser
 
+	// writev is only worth it on a plain socket, a tls conn writes
+	// a record per buffer, so the batch is merged
+	writev := false
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		writev = true
+	}
+
 	go func() {
-		for b := range tcpConn.writeChan {
-			if b == nil {
+		var items []writeItem
+		var batch net.Buffers
+		var merged []byte
+		for {
+			var ok bool
+			items, ok = tcpConn.queue.pop(items[:0])
+			if !ok {
 				break
 			}
 
-			_, err := conn.Write(b)
-			if err != nil {
+			// flush the queued messages with one writev
+			closing := false
+			batch = batch[:0]
+			for i := range items {
+				if items[i].b == nil {
+					closing = true
+					break
+				}
+				batch = items[i].append(batch, tcpConn.cipher)
+			}
+			for i := range items {
+				items[i] = writeItem{}
+			}
+
+			var err error
+			switch {
+			case len(batch) == 0:
+			case writev:
+				bufs := batch
+				_, err = bufs.WriteTo(conn)
+				tcpConn.writes.Add(1)
+			default:
+				merged = merged[:0]
+				for _, b := range batch {
+					merged = append(merged, b...)
+				}
+				_, err = conn.Write(merged)
+				tcpConn.writes.Add(1)
+				if cap(merged) > maxMergedLen {
+					merged = nil
+				}
+			}
+			for i := range batch {
+				batch[i] = nil
+			}
+			if err != nil || closing {
 				break
 			}
 		}
 
 		conn.Close()
+		tcpConn.queue.destroy()
 		tcpConn.Lock()
 		tcpConn.closeFlag = true
 		tcpConn.Unlock()
@@ -44,13 +104,13 @@ func newTCPConn(conn net.Conn, pendingWriteNum int, msgParser *MsgParser) *TCPCo
 }
 
 func (tcpConn *TCPConn) doDestroy() {
-	tcpConn.conn.(*net.TCPConn).SetLinger(0)
+	if c, ok := rawTCPConn(tcpConn.conn); ok {
+		c.SetLinger(0)
+	}
 	tcpConn.conn.Close()
 
-	if !tcpConn.closeFlag {
-		close(tcpConn.writeChan)
-		tcpConn.closeFlag = true
-	}
+	tcpConn.queue.destroy()
+	tcpConn.closeFlag = true
 }
 
 func (tcpConn *TCPConn) Destroy() {
@@ -67,33 +127,63 @@ func (tcpConn *TCPConn) Close() {
 		return
 	}
 
-	tcpConn.doWrite(nil)
+	if !tcpConn.queue.close() {
+		log.Debug("close conn: queue full")
+		tcpConn.doDestroy()
+	}
 	tcpConn.closeFlag = true
 }
 
-func (tcpConn *TCPConn) doWrite(b []byte) {
-	if len(tcpConn.writeChan) == cap(tcpConn.writeChan) {
-		log.Debug("close conn: channel full")
-		tcpConn.doDestroy()
+// b must not be modified by the others goroutines
+func (tcpConn *TCPConn) Write(b []byte) {
+	tcpConn.write(writeItem{b: b})
+}
+
+func (tcpConn *TCPConn) write(item writeItem) {
+	tcpConn.Lock()
+	closeFlag := tcpConn.closeFlag
+	tcpConn.Unlock()
+	if closeFlag || item.b == nil {
 		return
 	}
 
-	tcpConn.writeChan <- b
+	// the conn is not locked for the overflow policy, Block may wait
+	if !tcpConn.queue.push(tcpConn, item) {
+		tcpConn.Destroy()
+	}
 }
 
-// b must not be modified by the others goroutines
-func (tcpConn *TCPConn) Write(b []byte) {
-	tcpConn.Lock()
-	defer tcpConn.Unlock()
-	if tcpConn.closeFlag || b == nil {
+// onOverflow is called by the writing goroutine, it must not write to the conn
+func (tcpConn *TCPConn) setOverflow(policy OverflowPolicy, timeout time.Duration, key func(args [][]byte) string, onOverflow func(Conn)) {
+	tcpConn.queue.overflow = overflow{policy: policy, timeout: timeout, key: key, onOverflow: onOverflow}
+}
+
+func (tcpConn *TCPConn) borrowBuffer(n int) []byte {
+	tcpConn.readBuf = getBuffer(n)
+	return *tcpConn.readBuf
+}
+
+// goroutine not safe
+// releases the message returned by ReadMsg if it was borrowed from the buffer pool,
+// the message must not be used after that
+func (tcpConn *TCPConn) ReleaseMsg(b []byte) {
+	bp := tcpConn.readBuf
+	// b may be a part of the buffer, but always ends with it
+	if bp == nil || cap(b) == 0 || &b[:cap(b)][cap(b)-1] != &(*bp)[:cap(*bp)][cap(*bp)-1] {
 		return
 	}
 
-	tcpConn.doWrite(b)
+	tcpConn.readBuf = nil
+	putBuffer(bp)
 }
 
 func (tcpConn *TCPConn) Read(b []byte) (int, error) {
-	return tcpConn.conn.Read(b)
+	return tcpConn.reader.Read(b)
+}
+
+// reads the len of VarintCodec without a syscall per byte
+func (tcpConn *TCPConn) ReadByte() (byte, error) {
+	return tcpConn.reader.ReadByte()
 }
 
 func (tcpConn *TCPConn) LocalAddr() net.Addr {
@@ -104,10 +194,27 @@ func (tcpConn *TCPConn) RemoteAddr() net.Addr {
 	return tcpConn.conn.RemoteAddr()
 }
 
+func (tcpConn *TCPConn) setReadTimeout(firstMsgTimeout, idleTimeout time.Duration) {
+	tcpConn.timeout.firstMsgTimeout = firstMsgTimeout
+	tcpConn.timeout.idleTimeout = idleTimeout
+}
+
+// goroutine not safe
 func (tcpConn *TCPConn) ReadMsg() ([]byte, error) {
-	return tcpConn.msgParser.Read(tcpConn)
+	if tcpConn.timeout.enabled() {
+		tcpConn.conn.SetReadDeadline(tcpConn.timeout.deadline())
+	}
+	b, err := tcpConn.msgParser.Read(tcpConn)
+	return b, tcpConn.timeout.checkErr(err)
 }
 
+// args are copied, the caller may reuse them once WriteMsg returns
 func (tcpConn *TCPConn) WriteMsg(args ...[]byte) error {
 	return tcpConn.msgParser.Write(tcpConn, args...)
 }
+
+// args are written without being copied, for the buffers never modified,
+// such as the ones just marshaled
+func (tcpConn *TCPConn) WriteMsgNoCopy(args ...[]byte) error {
+	return tcpConn.msgParser.WriteNoCopy(tcpConn, args...)
+}
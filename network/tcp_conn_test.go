@@ -0,0 +1,101 @@
+package network
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func benchmarkWriteMsg(b *testing.B, size int, noCopy bool) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer ln.Close()
+
+	done := make(chan int64)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			done <- 0
+			return
+		}
+		n, _ := io.Copy(io.Discard, conn)
+		conn.Close()
+		done <- n
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	msgParser := NewMsgParser()
+	msgParser.SetMsgLen(4, 0, 0)
+	tcpConn := newTCPConn(conn, 1024, msgParser)
+	tcpConn.setOverflow(OverflowBlock, 10*time.Second, nil, nil)
+
+	id := []byte{0, 1}
+	body := make([]byte, size)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if noCopy {
+			err = tcpConn.WriteMsgNoCopy(id, body)
+		} else {
+			err = tcpConn.WriteMsg(id, body)
+		}
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	tcpConn.Close()
+	n := <-done
+	b.StopTimer()
+
+	if want := int64(b.N) * int64(4+len(id)+size); n != want {
+		b.Fatalf("read %v bytes, want %v", n, want)
+	}
+	b.ReportMetric(float64(tcpConn.writes.Load())/float64(b.N), "writes/msg")
+}
+
+func BenchmarkTCPConnWriteMsg16(b *testing.B) {
+	benchmarkWriteMsg(b, 16, false)
+}
+
+func BenchmarkTCPConnWriteMsg1K(b *testing.B) {
+	benchmarkWriteMsg(b, 1024, false)
+}
+
+func BenchmarkTCPConnWriteMsgNoCopy1K(b *testing.B) {
+	benchmarkWriteMsg(b, 1024, true)
+}
+
+// the args may be reused once WriteMsg returns
+func TestTCPConnWriteMsgCopy(t *testing.T) {
+	c1, c2 := net.Pipe()
+	msgParser := NewMsgParser()
+	w := newTCPConn(c1, 10, msgParser)
+	r := newTCPConn(c2, 10, msgParser)
+	defer w.Destroy()
+	defer r.Destroy()
+
+	// the pipe blocks the writer goroutine until the message is read
+	arg := []byte("hello")
+	if err := w.WriteMsg(arg, []byte(" leaf")); err != nil {
+		t.Fatal(err)
+	}
+	copy(arg, "HELLO")
+
+	data, err := r.ReadMsg()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello leaf" {
+		t.Fatalf("got %q", data)
+	}
+}
@@ -1,10 +1,9 @@
 package network
 
 import (
-	"encoding/binary"
 	"errors"
+	"github.com/name5566/leaf/log"
 	"io"
-	"math"
 )
 
 // --------------
@@ -15,6 +14,12 @@ type MsgParser struct {
 	minMsgLen    uint32
 	maxMsgLen    uint32
 	littleEndian bool
+	bufferPool   bool
+	codec        FrameCodec
+	customCodec  bool
+
+	// messages of compressThreshold bytes or more are compressed
+	compressThreshold int
 }
 
 func NewMsgParser() *MsgParser {
@@ -23,11 +28,13 @@ func NewMsgParser() *MsgParser {
 	p.minMsgLen = 1
 	p.maxMsgLen = 4096
 	p.littleEndian = false
+	p.codec = FixedLenCodec{Size: p.lenMsgLen, LittleEndian: p.littleEndian}
 
 	return p
 }
 
 // It's dangerous to call the method on reading or writing
+// lenMsgLen is ignored if a frame codec is set
 func (p *MsgParser) SetMsgLen(lenMsgLen int, minMsgLen uint32, maxMsgLen uint32) {
 	if lenMsgLen == 1 || lenMsgLen == 2 || lenMsgLen == 4 {
 		p.lenMsgLen = lenMsgLen
@@ -39,14 +46,53 @@ func (p *MsgParser) SetMsgLen(lenMsgLen int, minMsgLen uint32, maxMsgLen uint32)
 		p.maxMsgLen = maxMsgLen
 	}
 
-	var max uint32
-	switch p.lenMsgLen {
-	case 1:
-		max = math.MaxUint8
-	case 2:
-		max = math.MaxUint16
-	case 4:
-		max = math.MaxUint32
+	if !p.customCodec {
+		p.codec = FixedLenCodec{Size: p.lenMsgLen, LittleEndian: p.littleEndian}
+	}
+	p.clampMsgLen()
+}
+
+// It's dangerous to call the method on reading or writing
+// littleEndian is ignored if a frame codec is set
+func (p *MsgParser) SetByteOrder(littleEndian bool) {
+	p.littleEndian = littleEndian
+
+	if !p.customCodec {
+		p.codec = FixedLenCodec{Size: p.lenMsgLen, LittleEndian: p.littleEndian}
+	}
+}
+
+// It's dangerous to call the method on reading or writing
+// the codec replaces the fixed-width len field set by SetMsgLen and SetByteOrder,
+// it should be set before SetMsgLen for the message len not to be clamped to the latter
+func (p *MsgParser) SetFrameCodec(codec FrameCodec) {
+	if codec == nil {
+		return
+	}
+	if c, ok := codec.(FixedLenCodec); ok && !c.valid() {
+		log.Fatal("invalid FixedLenCodec size %v", c.Size)
+	}
+
+	p.codec = codec
+	p.customCodec = true
+	p.clampMsgLen()
+}
+
+// It's dangerous to call the method on reading or writing
+// messages of threshold bytes or more are compressed, zero disables compression
+// a flag byte is put in front of the data of every message once enabled,
+// so compression must be enabled on both ends or neither, TCPServer and
+// TCPClient check it on connect
+func (p *MsgParser) SetCompression(threshold int) {
+	p.compressThreshold = threshold
+	p.clampMsgLen()
+}
+
+func (p *MsgParser) clampMsgLen() {
+	max := p.codec.MaxLen()
+	if p.compressThreshold > 0 {
+		// room for the flag byte
+		max--
 	}
 	if p.minMsgLen > max {
 		p.minMsgLen = max
@@ -57,57 +103,99 @@ func (p *MsgParser) SetMsgLen(lenMsgLen int, minMsgLen uint32, maxMsgLen uint32)
 }
 
 // It's dangerous to call the method on reading or writing
-func (p *MsgParser) SetByteOrder(littleEndian bool) {
-	p.littleEndian = littleEndian
+// with the buffer pool enabled, the message returned by Read is borrowed
+// and should be released by TCPConn.ReleaseMsg once it's no longer used
+func (p *MsgParser) SetBufferPool(enable bool) {
+	p.bufferPool = enable
 }
 
 // goroutine safe
 func (p *MsgParser) Read(conn *TCPConn) ([]byte, error) {
-	var b [4]byte
-	bufMsgLen := b[:p.lenMsgLen]
-
 	// read len
-	if _, err := io.ReadFull(conn, bufMsgLen); err != nil {
+	msgLen, err := p.codec.ReadLen(conn)
+	if err != nil {
 		return nil, err
 	}
 
-	// parse len
-	var msgLen uint32
-	switch p.lenMsgLen {
-	case 1:
-		msgLen = uint32(bufMsgLen[0])
-	case 2:
-		if p.littleEndian {
-			msgLen = uint32(binary.LittleEndian.Uint16(bufMsgLen))
-		} else {
-			msgLen = uint32(binary.BigEndian.Uint16(bufMsgLen))
-		}
-	case 4:
-		if p.littleEndian {
-			msgLen = binary.LittleEndian.Uint32(bufMsgLen)
-		} else {
-			msgLen = binary.BigEndian.Uint32(bufMsgLen)
-		}
-	}
-
 	// check len
-	if msgLen > p.maxMsgLen {
+	var extra uint32
+	if p.compressThreshold > 0 {
+		extra++
+	}
+	if conn.cipher != nil {
+		extra += cipherOverhead
+	}
+	if msgLen < extra {
+		return nil, errors.New("message too short")
+	}
+	if dataLen := msgLen - extra; dataLen > p.maxMsgLen {
 		return nil, errors.New("message too long")
-	} else if msgLen < p.minMsgLen {
+	} else if dataLen < p.minMsgLen {
 		return nil, errors.New("message too short")
 	}
 
 	// data
-	msgData := make([]byte, msgLen)
+	var msgData []byte
+	if p.bufferPool && msgLen > 0 {
+		msgData = conn.borrowBuffer(int(msgLen))
+	} else {
+		msgData = make([]byte, msgLen)
+	}
 	if _, err := io.ReadFull(conn, msgData); err != nil {
+		conn.ReleaseMsg(msgData)
 		return nil, err
 	}
 
+	// decrypt
+	if conn.cipher != nil {
+		data, err := conn.cipher.open(msgData)
+		if err != nil {
+			conn.ReleaseMsg(msgData)
+			return nil, err
+		}
+		msgData = data
+	}
+
+	if p.compressThreshold > 0 {
+		return p.decompress(conn, msgData)
+	}
 	return msgData, nil
 }
 
+func (p *MsgParser) decompress(conn *TCPConn, msgData []byte) ([]byte, error) {
+	switch msgData[0] {
+	case flagRaw:
+		return msgData[1:], nil
+	case flagDeflate:
+		data, err := inflate(msgData[1:], p.maxMsgLen)
+		conn.ReleaseMsg(msgData)
+		if err != nil {
+			return nil, err
+		}
+		if uint32(len(data)) < p.minMsgLen {
+			return nil, errors.New("message too short")
+		}
+		return data, nil
+	default:
+		conn.ReleaseMsg(msgData)
+		return nil, errors.New("invalid compression flag")
+	}
+}
+
 // goroutine safe
+// args are copied, the caller may reuse them once Write returns
 func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
+	return p.write(conn, args, true)
+}
+
+// goroutine safe
+// args are written without being copied, they must not be modified until
+// written, which the caller can't know, so they must never be modified
+func (p *MsgParser) WriteNoCopy(conn *TCPConn, args ...[]byte) error {
+	return p.write(conn, args, false)
+}
+
+func (p *MsgParser) write(conn *TCPConn, args [][]byte, copyArgs bool) error {
 	// get len
 	var msgLen uint32
 	for i := 0; i < len(args); i++ {
@@ -121,34 +209,58 @@ func (p *MsgParser) Write(conn *TCPConn, args ...[]byte) error {
 		return errors.New("message too short")
 	}
 
-	msg := make([]byte, uint32(p.lenMsgLen)+msgLen)
+	key := conn.queue.msgKey(args)
 
-	// write len
-	switch p.lenMsgLen {
-	case 1:
-		msg[0] = byte(msgLen)
-	case 2:
-		if p.littleEndian {
-			binary.LittleEndian.PutUint16(msg, uint16(msgLen))
-		} else {
-			binary.BigEndian.PutUint16(msg, uint16(msgLen))
-		}
-	case 4:
-		if p.littleEndian {
-			binary.LittleEndian.PutUint32(msg, msgLen)
-		} else {
-			binary.BigEndian.PutUint32(msg, msgLen)
+	// compress
+	var flag []byte
+	compressed := false
+	if p.compressThreshold > 0 {
+		flag = flags[flagRaw : flagRaw+1]
+		if msgLen >= uint32(p.compressThreshold) {
+			data, err := deflate(args)
+			if err != nil {
+				return err
+			}
+			if uint32(len(data)) < msgLen {
+				flag = flags[flagDeflate : flagDeflate+1]
+				args = [][]byte{data}
+				msgLen = uint32(len(data))
+				compressed = true
+			}
 		}
 	}
 
-	// write data
-	l := p.lenMsgLen
-	for i := 0; i < len(args); i++ {
-		copy(msg[l:], args[i])
-		l += len(args[i])
+	frameLen := uint64(msgLen) + uint64(len(flag))
+	if conn.cipher != nil {
+		frameLen += cipherOverhead
 	}
+	if frameLen > uint64(p.codec.MaxLen()) {
+		return errors.New("message too long")
+	}
+
+	// the compressed data is not shared with the caller
+	copyArgs = copyArgs && !compressed
+	seal := conn.cipher != nil
 
-	conn.Write(msg)
+	size := p.codec.MaxHeaderLen() + len(flag)
+	if copyArgs && !seal {
+		// room for the data merged with the header
+		size += int(msgLen)
+	}
+	header := p.codec.AppendLen(make([]byte, 0, size), uint32(frameLen))
+	item := writeItem{b: header, args: args, key: key, seal: seal}
+	if flag != nil {
+		// the flag byte is sealed with the data
+		if item.seal {
+			item.args = append([][]byte{flag}, args...)
+		} else {
+			item.b = append(item.b, flag...)
+		}
+	}
+	if copyArgs {
+		item.merge()
+	}
+	conn.write(item)
 
 	return nil
 }
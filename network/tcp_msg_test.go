@@ -0,0 +1,64 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+// loopConn reads the same frame over and over
+type loopConn struct {
+	net.Conn
+	frame []byte
+	off   int
+}
+
+func (c *loopConn) Read(b []byte) (int, error) {
+	n := copy(b, c.frame[c.off:])
+	c.off = (c.off + n) % len(c.frame)
+	return n, nil
+}
+
+func (c *loopConn) Close() error {
+	return nil
+}
+
+func benchmarkReadMsg(b *testing.B, size int, bufferPool bool) {
+	msgParser := NewMsgParser()
+	msgParser.SetMsgLen(4, 0, 64*1024)
+	msgParser.SetBufferPool(bufferPool)
+
+	frame := make([]byte, 4+size)
+	frame[2], frame[3] = byte(size>>8), byte(size)
+	tcpConn := newTCPConn(&loopConn{frame: frame}, 1, msgParser)
+	defer tcpConn.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		data, err := tcpConn.ReadMsg()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(data) != size {
+			b.Fatalf("read %v bytes, want %v", len(data), size)
+		}
+		tcpConn.ReleaseMsg(data)
+	}
+}
+
+func BenchmarkTCPConnReadMsg1K(b *testing.B) {
+	benchmarkReadMsg(b, 1024, false)
+}
+
+func BenchmarkTCPConnReadMsg1KPooled(b *testing.B) {
+	benchmarkReadMsg(b, 1024, true)
+}
+
+func BenchmarkTCPConnReadMsg32K(b *testing.B) {
+	benchmarkReadMsg(b, 32*1024, false)
+}
+
+func BenchmarkTCPConnReadMsg32KPooled(b *testing.B) {
+	benchmarkReadMsg(b, 32*1024, true)
+}
@@ -1,19 +1,35 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/name5566/leaf/log"
+	"math"
 	"net"
+	"os"
 	"sync"
 	"time"
 )
 
+// Addr may be a unix domain socket, for example "unix:/tmp/leaf.sock"
 type TCPServer struct {
 	Addr            string
+	UnixMode        os.FileMode // permissions of the unix domain socket, zero keeps the umask
 	MaxConnNum      int
 	PendingWriteNum int
+	FirstMsgTimeout time.Duration
+	IdleTimeout     time.Duration
+	KeepAlive       time.Duration
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceKey     func(args [][]byte) string
+	OnOverflow      func(Conn)
 	NewAgent        func(*TCPConn) Agent
+	OnDrain         func(Agent)
 	ln              net.Listener
 	conns           ConnSet
+	agents          map[Agent]struct{}
+	draining        bool
 	mutexConns      sync.Mutex
 	wgLn            sync.WaitGroup
 	wgConns         sync.WaitGroup
@@ -23,7 +39,34 @@ type TCPServer struct {
 	MinMsgLen    uint32
 	MaxMsgLen    uint32
 	LittleEndian bool
+	BufferPool   bool
+	FrameCodec   FrameCodec // replaces LenMsgLen and LittleEndian if not nil
 	msgParser    *MsgParser
+
+	// compression, messages of CompressThreshold bytes or more are compressed,
+	// zero disables it, the peer must enable compression too, see compress.go
+	CompressThreshold int
+
+	// tls, enabled by any of the files
+	// CAFile verifies client certificates (mutual tls)
+	CertFile  string
+	KeyFile   string
+	CAFile    string
+	TLSConfig *tls.Config // used instead of the files if not nil
+
+	// session encryption for clients unable to do tls, the clients must
+	// enable it too, see cipher.go
+	Encrypt bool
+
+	// connection limits, zero means no limit
+	// AllowCIDRs and DenyCIDRs take networks or single ips, for example
+	// "10.0.0.0/8" or "192.168.1.1", only AllowCIDRs may connect if not empty
+	MaxConnPerIP int
+	AcceptRate   float64 // new connections per second
+	AcceptBurst  int
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	limiter      *connLimiter
 }
 
 func (server *TCPServer) Start() {
@@ -32,11 +75,31 @@ func (server *TCPServer) Start() {
 }
 
 func (server *TCPServer) init() {
-	ln, err := net.Listen("tcp", server.Addr)
+	network, address := splitAddr(server.Addr)
+	lc := net.ListenConfig{KeepAlive: server.KeepAlive}
+	var ln net.Listener
+	var err error
+	if network == "unix" {
+		removeStaleSocket(address)
+		ln, err = listenUnix(&lc, address, server.UnixMode)
+	} else {
+		ln, err = lc.Listen(context.Background(), network, address)
+	}
 	if err != nil {
 		log.Fatal("%v", err)
 	}
 
+	if server.TLSConfig == nil && (server.CertFile != "" || server.KeyFile != "" || server.CAFile != "") {
+		config, err := newTLSConfig(server.CertFile, server.KeyFile, server.CAFile, true)
+		if err != nil {
+			log.Fatal("%v", err)
+		}
+		server.TLSConfig = config
+	}
+	if server.TLSConfig != nil {
+		ln = tls.NewListener(ln, server.TLSConfig)
+	}
+
 	if server.MaxConnNum <= 0 {
 		server.MaxConnNum = 100
 		log.Release("invalid MaxConnNum, reset to %v", server.MaxConnNum)
@@ -45,17 +108,32 @@ func (server *TCPServer) init() {
 		server.PendingWriteNum = 100
 		log.Release("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
 	}
+	checkOverflow(server.OverflowPolicy, &server.OverflowTimeout)
+	if server.AcceptRate > 0 && server.AcceptBurst <= 0 {
+		server.AcceptBurst = int(math.Ceil(server.AcceptRate))
+		log.Release("invalid AcceptBurst, reset to %v", server.AcceptBurst)
+	}
+	limiter, err := newConnLimiter(server.MaxConnPerIP, server.AcceptRate, server.AcceptBurst, server.AllowCIDRs, server.DenyCIDRs)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
 	if server.NewAgent == nil {
 		log.Fatal("NewAgent must not be nil")
 	}
 
 	server.ln = ln
+	server.limiter = limiter
 	server.conns = make(ConnSet)
+	server.agents = make(map[Agent]struct{})
+	server.draining = false
 
 	// msg parser
 	msgParser := NewMsgParser()
+	msgParser.SetFrameCodec(server.FrameCodec)
 	msgParser.SetMsgLen(server.LenMsgLen, server.MinMsgLen, server.MaxMsgLen)
 	msgParser.SetByteOrder(server.LittleEndian)
+	msgParser.SetBufferPool(server.BufferPool)
+	msgParser.SetCompression(server.CompressThreshold)
 	server.msgParser = msgParser
 }
 
@@ -84,11 +162,18 @@ func (server *TCPServer) run() {
 		}
 		tempDelay = 0
 
+		ip, err := server.limiter.acquire(conn.RemoteAddr().String())
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
 		server.mutexConns.Lock()
 		if len(server.conns) >= server.MaxConnNum {
 			server.mutexConns.Unlock()
 			conn.Close()
-			log.Debug("too many connections")
+			server.limiter.release(ip)
+			server.limiter.rejectMaxConn()
 			continue
 		}
 		server.conns[conn] = struct{}{}
@@ -97,22 +182,78 @@ func (server *TCPServer) run() {
 		server.wgConns.Add(1)
 
 		tcpConn := newTCPConn(conn, server.PendingWriteNum, server.msgParser)
-		agent := server.NewAgent(tcpConn)
+		tcpConn.setReadTimeout(server.FirstMsgTimeout, server.IdleTimeout)
+		tcpConn.setOverflow(server.OverflowPolicy, server.OverflowTimeout, server.CoalesceKey, server.OnOverflow)
 		go func() {
-			agent.Run()
+			var agent Agent
+			if server.handshake(tcpConn) {
+				agent = server.newAgent(tcpConn)
+			}
+			if agent != nil {
+				agent.Run()
+			}
 
 			// cleanup
 			tcpConn.Close()
 			server.mutexConns.Lock()
 			delete(server.conns, conn)
+			delete(server.agents, agent)
 			server.mutexConns.Unlock()
-			agent.OnClose()
+			server.limiter.release(ip)
+			if agent != nil {
+				agent.OnClose()
+			}
 
 			server.wgConns.Done()
 		}()
 	}
 }
 
+// returns nil once draining, the agent is drained here if Drain starts
+// while it's created
+func (server *TCPServer) newAgent(tcpConn *TCPConn) Agent {
+	server.mutexConns.Lock()
+	draining := server.draining
+	server.mutexConns.Unlock()
+	if draining {
+		return nil
+	}
+
+	agent := server.NewAgent(tcpConn)
+	server.mutexConns.Lock()
+	server.agents[agent] = struct{}{}
+	draining = server.draining
+	server.mutexConns.Unlock()
+	if draining && server.OnDrain != nil {
+		server.OnDrain(agent)
+	}
+	return agent
+}
+
+func (server *TCPServer) Rejected() RejectStats {
+	return server.limiter.stats()
+}
+
+func (server *TCPServer) handshake(tcpConn *TCPConn) bool {
+	if server.CompressThreshold > 0 {
+		err := tcpConn.compressHandshake(true)
+		if err != nil {
+			log.Debug("compression handshake with %v error: %v", tcpConn.RemoteAddr(), err)
+			return false
+		}
+	}
+	if !server.Encrypt {
+		return true
+	}
+
+	err := tcpConn.handshake(true)
+	if err != nil {
+		log.Debug("handshake with %v error: %v", tcpConn.RemoteAddr(), err)
+		return false
+	}
+	return true
+}
+
 func (server *TCPServer) Close() {
 	server.ln.Close()
 	server.wgLn.Wait()
@@ -125,3 +266,39 @@ func (server *TCPServer) Close() {
 	server.mutexConns.Unlock()
 	server.wgConns.Wait()
 }
+
+// Drain stops accepting, calls OnDrain for every live agent, waits up to
+// timeout for the agents to disconnect and then closes the rest
+func (server *TCPServer) Drain(timeout time.Duration) {
+	server.ln.Close()
+	server.wgLn.Wait()
+
+	server.mutexConns.Lock()
+	server.draining = true
+	agents := make([]Agent, 0, len(server.agents))
+	for agent := range server.agents {
+		agents = append(agents, agent)
+	}
+	server.mutexConns.Unlock()
+
+	if server.OnDrain != nil {
+		for _, agent := range agents {
+			server.OnDrain(agent)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wgConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		server.mutexConns.Lock()
+		log.Release("drain timeout, close %v connections", len(server.conns))
+		server.mutexConns.Unlock()
+	}
+
+	server.Close()
+}
@@ -0,0 +1,160 @@
+package network
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "leaf.sock")
+
+	// a socket file left by a crashed process
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	server := &TCPServer{
+		Addr:     "unix:" + path,
+		UnixMode: 0600,
+		NewAgent: func(conn *TCPConn) Agent {
+			return &loopbackAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0600 {
+		t.Fatalf("socket mode %v, want 0600", perm)
+	}
+
+	// a live socket is not removed
+	removeStaleSocket(path)
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal("live socket removed")
+	}
+
+	msgs := make(chan []byte, 1)
+	conns := make(chan *TCPConn, 1)
+	client := &TCPClient{
+		Addr: "unix:" + path,
+		NewAgent: func(conn *TCPConn) Agent {
+			conns <- conn
+			return &loopbackAgent{conn: conn, msgs: msgs}
+		},
+	}
+	client.Start()
+	defer client.Close()
+
+	conn := <-conns
+	conn.WriteMsg([]byte("hello"), []byte(" leaf"))
+	select {
+	case msg := <-msgs:
+		if string(msg) != "hello leaf" {
+			t.Fatalf("got %q", msg)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no echo")
+	}
+}
+
+type drainAgent struct {
+	conn   Conn
+	polite bool // closes the conn once drained
+	done   chan struct{}
+}
+
+func (a *drainAgent) Run() {
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			break
+		}
+	}
+	close(a.done)
+}
+
+func (a *drainAgent) OnClose() {}
+
+// an agent created while Drain starts is drained too
+func TestTCPServerDrain(t *testing.T) {
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	agents := make(chan *drainAgent, 2)
+	drained := make(chan *drainAgent, 2)
+	n := 0
+	server := &TCPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *TCPConn) Agent {
+			a := &drainAgent{conn: conn, done: make(chan struct{})}
+			n++
+			if n == 1 {
+				a.polite = true
+			} else {
+				creating <- struct{}{}
+				<-release
+			}
+			agents <- a
+			return a
+		},
+		OnDrain: func(agent Agent) {
+			a := agent.(*drainAgent)
+			drained <- a
+			if a.polite {
+				a.conn.Close()
+			}
+		},
+	}
+	server.Start()
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", server.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if i == 0 {
+			<-agents
+		}
+	}
+	<-creating
+
+	drainDone := make(chan struct{})
+	go func() {
+		server.Drain(200 * time.Millisecond)
+		close(drainDone)
+	}()
+	for draining := false; !draining; time.Sleep(time.Millisecond) {
+		server.mutexConns.Lock()
+		draining = server.draining
+		server.mutexConns.Unlock()
+	}
+	close(release)
+	straggler := <-agents
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-drained:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%v agents drained, want 2", i)
+		}
+	}
+	select {
+	case <-drainDone:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Drain not returned")
+	}
+	select {
+	case <-straggler.done:
+	default:
+		t.Fatal("straggler not closed")
+	}
+}
@@ -0,0 +1,58 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"os"
+)
+
+// certFile and keyFile are the certificate presented to the peer, caFile
+// verifies the certificate of the peer, on a server it makes the client
+// certificate required (mutual tls)
+func newTLSConfig(certFile, keyFile, caFile string, server bool) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("tls certificate and key required together")
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+		if server {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = pool
+		}
+	}
+
+	if server && len(config.Certificates) == 0 {
+		return nil, errors.New("server certificate required")
+	}
+	return config, nil
+}
+
+// the tcp conn under a tls conn
+func rawTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	c, ok := conn.(*net.TCPConn)
+	return c, ok
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates of a test
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	File string
+}
+
+func newTestCA(t *testing.T) *testCA {
+	ca := &testCA{t: t, dir: t.TempDir()}
+	ca.cert, ca.key, ca.File, _ = ca.issue("ca", nil, &x509.Certificate{
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	})
+	return ca
+}
+
+// issue writes a certificate and its key and returns their files
+func (ca *testCA) issue(name string, parent *testCA, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.Subject = pkix.Name{CommonName: name}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		ca.t.Fatal(err)
+	}
+
+	certFile := filepath.Join(ca.dir, name+".crt")
+	keyFile := filepath.Join(ca.dir, name+".key")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return cert, key, certFile, keyFile
+}
+
+func (ca *testCA) server() (string, string) {
+	_, _, certFile, keyFile := ca.issue("server", ca, &x509.Certificate{
+		DNSNames:    []string{"leaf.test"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	return certFile, keyFile
+}
+
+func (ca *testCA) client() (string, string) {
+	_, _, certFile, keyFile := ca.issue("client", ca, &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	})
+	return certFile, keyFile
+}
+
+// echo starts client and returns whether a message is echoed by server
+func echo(t *testing.T, server *TCPServer, client *TCPClient) bool {
+	server.Addr = "127.0.0.1:0"
+	server.NewAgent = func(conn *TCPConn) Agent {
+		return &loopbackAgent{conn: conn}
+	}
+	server.Start()
+	defer server.Close()
+
+	msgs := make(chan []byte, 1)
+	conns := make(chan *TCPConn, 1)
+	client.Addr = server.ln.Addr().String()
+	client.ConnectInterval = 50 * time.Millisecond
+	client.NewAgent = func(conn *TCPConn) Agent {
+		conns <- conn
+		return &loopbackAgent{conn: conn, msgs: msgs}
+	}
+	client.Start()
+	defer client.Close()
+
+	var conn *TCPConn
+	select {
+	case conn = <-conns:
+	case <-time.After(time.Second):
+		return false
+	}
+	conn.WriteMsg([]byte("hello"))
+	select {
+	case msg := <-msgs:
+		return string(msg) == "hello"
+	case <-time.After(time.Second):
+		return false
+	}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.server()
+
+	// the ca alone enables tls
+	server := &TCPServer{CertFile: certFile, KeyFile: keyFile}
+	if !echo(t, server, &TCPClient{CAFile: ca.File}) {
+		t.Fatal("tls failed")
+	}
+	if !echo(t, &TCPServer{CertFile: certFile, KeyFile: keyFile}, &TCPClient{CAFile: ca.File, ServerName: "leaf.test"}) {
+		t.Fatal("tls with a server name failed")
+	}
+
+	// the server isn't trusted
+	other := newTestCA(t)
+	if echo(t, &TCPServer{CertFile: certFile, KeyFile: keyFile}, &TCPClient{CAFile: other.File}) {
+		t.Fatal("untrusted server accepted")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := ca.server()
+	clientCert, clientKey := ca.client()
+
+	server := &TCPServer{CertFile: certFile, KeyFile: keyFile, CAFile: ca.File}
+	client := &TCPClient{CertFile: clientCert, KeyFile: clientKey, CAFile: ca.File}
+	if !echo(t, server, client) {
+		t.Fatal("mutual tls failed")
+	}
+
+	// a client without a certificate
+	server = &TCPServer{CertFile: certFile, KeyFile: keyFile, CAFile: ca.File}
+	if echo(t, server, &TCPClient{CAFile: ca.File}) {
+		t.Fatal("client without a certificate accepted")
+	}
+}
+
+func TestTLSConfigIncomplete(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, _ := ca.server()
+	if _, err := newTLSConfig(certFile, "", "", false); err == nil {
+		t.Fatal("certificate without a key accepted")
+	}
+	if _, err := newTLSConfig("", "", ca.File, true); err == nil {
+		t.Fatal("server without a certificate accepted")
+	}
+}
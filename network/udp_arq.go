@@ -0,0 +1,477 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// reliable udp, a simplified kcp
+//
+// a datagram holds one or more segments:
+// ---------------------------------------------------------------------
+// | conv (4) | cmd (1) | frg (1) | wnd (2) | ts (4) | sn (4) | una (4) | len (2) | data |
+// ---------------------------------------------------------------------
+// conv is the session id, chosen by the client
+// frg counts down the fragments left of a message, 0 for the last one
+// wnd is the free receive window of the sender in segments
+// ts is the send time of a push, echoed by its ack for the rtt
+// una is the next sn the sender expects, everything before it is received
+//
+// a session is opened by a cookie handshake, so that the server keeps no
+// state for a spoofed address:
+//
+//	client hello:   hello with 16 zero bytes
+//	server cookie:  cookie with the cookie of the address and conv
+//	client hello:   hello with the cookie
+//	server accept:  hello with no data
+//
+// hello and cookie are not segments of the arq, they have a datagram of
+// their own with the other header fields zero
+const (
+	udpHeaderLen = 22
+	udpMTU       = 1400
+	udpMSS       = udpMTU - udpHeaderLen
+	udpWnd       = 128             // send and receive window in segments
+	udpMaxMsgLen = udpWnd * udpMSS // a message must fit in the receive window
+
+	udpCookieLen   = 16
+	udpCookieEpoch = 30 * time.Second // a cookie is valid for one or two epochs
+
+	udpInterval     = 10 * time.Millisecond
+	udpPingInterval = time.Second
+	udpMinRTO       = 30 * time.Millisecond
+	udpInitRTO      = 200 * time.Millisecond
+	udpMaxRTO       = 5 * time.Second
+	udpMaxXmit      = 20 // the link is dead once a segment is sent that many times
+	udpFastResend   = 2  // resend a segment skipped by that many acks
+)
+
+const (
+	udpPush byte = iota + 1
+	udpAck
+	udpPing
+	udpFin
+	udpHello
+	udpCookie
+)
+
+type udpSegment struct {
+	cmd      byte
+	frg      uint8
+	wnd      uint16
+	ts       uint32
+	sn       uint32
+	una      uint32
+	data     []byte
+	resendAt time.Time
+	rto      time.Duration
+	xmit     int
+	fastack  int
+}
+
+// serial number arithmetic, a is before b
+func snBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// not goroutine safe
+type udpARQ struct {
+	conv   uint32
+	output func([]byte)
+	start  time.Time
+
+	sndNxt   uint32
+	sndUna   uint32
+	sndQueue []*udpSegment // waiting for the window
+	sndBuf   []*udpSegment // sent, not acked, ordered by sn
+	rmtWnd   uint16
+	cwnd     int
+	ssthresh int
+	incr     int
+
+	rcvNxt   uint32
+	rcvBuf   map[uint32]*udpSegment // out of order
+	rcvQueue []*udpSegment          // in order, not read
+	acks     []udpSegment
+
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	lastSend time.Time
+	dead     bool
+	fin      bool // the peer has closed
+	buf      []byte
+}
+
+func newUDPARQ(conv uint32, output func([]byte)) *udpARQ {
+	arq := new(udpARQ)
+	arq.conv = conv
+	arq.output = output
+	arq.start = time.Now()
+	arq.rmtWnd = udpWnd
+	arq.cwnd = 1
+	arq.ssthresh = udpWnd
+	arq.rcvBuf = make(map[uint32]*udpSegment)
+	arq.rto = udpInitRTO
+	arq.buf = make([]byte, 0, udpMTU)
+	return arq
+}
+
+func (arq *udpARQ) now(t time.Time) uint32 {
+	return uint32(t.Sub(arq.start) / time.Millisecond)
+}
+
+// data is kept by the arq
+func (arq *udpARQ) send(data []byte) error {
+	n := (len(data) + udpMSS - 1) / udpMSS
+	if n == 0 {
+		n = 1
+	}
+	if len(data) > udpMaxMsgLen {
+		return errors.New("message too long")
+	}
+
+	for i := 0; i < n; i++ {
+		size := len(data)
+		if size > udpMSS {
+			size = udpMSS
+		}
+		arq.sndQueue = append(arq.sndQueue, &udpSegment{
+			cmd:  udpPush,
+			frg:  uint8(n - 1 - i),
+			data: data[:size],
+		})
+		data = data[size:]
+	}
+	return nil
+}
+
+// returns the next complete message
+func (arq *udpARQ) recv() ([]byte, bool) {
+	if len(arq.rcvQueue) == 0 {
+		return nil, false
+	}
+	n := int(arq.rcvQueue[0].frg) + 1
+	if len(arq.rcvQueue) < n {
+		return nil, false
+	}
+
+	var msg []byte
+	if n == 1 {
+		msg = arq.rcvQueue[0].data
+	} else {
+		for _, seg := range arq.rcvQueue[:n] {
+			msg = append(msg, seg.data...)
+		}
+	}
+	for i := 0; i < n; i++ {
+		arq.rcvQueue[i] = nil
+	}
+	arq.rcvQueue = arq.rcvQueue[n:]
+
+	// room for the segments waiting in rcvBuf
+	arq.moveRcvBuf()
+	return msg, true
+}
+
+func (arq *udpARQ) moveRcvBuf() {
+	for len(arq.rcvQueue) < udpWnd {
+		seg, ok := arq.rcvBuf[arq.rcvNxt]
+		if !ok {
+			break
+		}
+		delete(arq.rcvBuf, arq.rcvNxt)
+		arq.rcvQueue = append(arq.rcvQueue, seg)
+		arq.rcvNxt++
+	}
+}
+
+// the segments with the right conv in the datagram are processed
+func (arq *udpARQ) input(b []byte, now time.Time) error {
+	acked := false
+	for len(b) > 0 {
+		if len(b) < udpHeaderLen {
+			return errors.New("invalid udp segment")
+		}
+		var seg udpSegment
+		conv := binary.BigEndian.Uint32(b)
+		seg.cmd = b[4]
+		seg.frg = b[5]
+		seg.wnd = binary.BigEndian.Uint16(b[6:])
+		seg.ts = binary.BigEndian.Uint32(b[8:])
+		seg.sn = binary.BigEndian.Uint32(b[12:])
+		seg.una = binary.BigEndian.Uint32(b[16:])
+		l := int(binary.BigEndian.Uint16(b[20:]))
+		b = b[udpHeaderLen:]
+		if conv != arq.conv || l > len(b) {
+			return errors.New("invalid udp segment")
+		}
+		data := b[:l]
+		b = b[l:]
+
+		arq.rmtWnd = seg.wnd
+		arq.ackUna(seg.una)
+
+		switch seg.cmd {
+		case udpAck:
+			rtt := time.Duration(arq.now(now)-seg.ts) * time.Millisecond
+			if rtt >= 0 && rtt < udpMaxRTO*4 {
+				arq.updateRTT(rtt)
+			}
+			arq.ackSn(seg.sn)
+			acked = true
+		case udpPush:
+			if snBefore(seg.sn, arq.rcvNxt+udpWnd) {
+				arq.acks = append(arq.acks, udpSegment{sn: seg.sn, ts: seg.ts})
+				if !snBefore(seg.sn, arq.rcvNxt) {
+					if _, ok := arq.rcvBuf[seg.sn]; !ok {
+						seg.data = append([]byte(nil), data...)
+						arq.rcvBuf[seg.sn] = &seg
+					}
+					arq.moveRcvBuf()
+				}
+			}
+		case udpPing:
+		case udpFin:
+			arq.fin = true
+		default:
+			return errors.New("invalid udp command")
+		}
+	}
+
+	if acked {
+		arq.shrinkBuf()
+	}
+	return nil
+}
+
+func (arq *udpARQ) updateRTT(rtt time.Duration) {
+	if arq.srtt == 0 {
+		arq.srtt = rtt
+		arq.rttvar = rtt / 2
+	} else {
+		delta := rtt - arq.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		arq.rttvar = (3*arq.rttvar + delta) / 4
+		arq.srtt = (7*arq.srtt + rtt) / 8
+	}
+
+	v := 4 * arq.rttvar
+	if v < udpInterval {
+		v = udpInterval
+	}
+	arq.rto = arq.srtt + v
+	if arq.rto < udpMinRTO {
+		arq.rto = udpMinRTO
+	} else if arq.rto > udpMaxRTO {
+		arq.rto = udpMaxRTO
+	}
+}
+
+// every segment before una is received
+func (arq *udpARQ) ackUna(una uint32) {
+	n := 0
+	for _, seg := range arq.sndBuf {
+		if !snBefore(seg.sn, una) {
+			break
+		}
+		n++
+	}
+	if n > 0 {
+		arq.acked(n)
+		arq.sndBuf = arq.sndBuf[n:]
+		arq.shrinkBuf()
+	}
+}
+
+func (arq *udpARQ) ackSn(sn uint32) {
+	for i, seg := range arq.sndBuf {
+		if seg.sn == sn {
+			arq.acked(1)
+			arq.sndBuf = append(arq.sndBuf[:i], arq.sndBuf[i+1:]...)
+			return
+		}
+		if snBefore(sn, seg.sn) {
+			return
+		}
+		// skipped by a later ack
+		seg.fastack++
+	}
+}
+
+// congestion window grows with acked segments
+func (arq *udpARQ) acked(n int) {
+	for ; n > 0 && arq.cwnd < udpWnd; n-- {
+		if arq.cwnd < arq.ssthresh {
+			arq.cwnd++
+			continue
+		}
+		arq.incr++
+		if arq.incr >= arq.cwnd {
+			arq.incr = 0
+			arq.cwnd++
+		}
+	}
+}
+
+func (arq *udpARQ) shrinkBuf() {
+	if len(arq.sndBuf) > 0 {
+		arq.sndUna = arq.sndBuf[0].sn
+	} else {
+		arq.sndUna = arq.sndNxt
+	}
+}
+
+// all the data is acked
+func (arq *udpARQ) idle() bool {
+	return len(arq.sndQueue) == 0 && len(arq.sndBuf) == 0
+}
+
+func (arq *udpARQ) wnd() uint16 {
+	if len(arq.rcvQueue) >= udpWnd {
+		return 0
+	}
+	return uint16(udpWnd - len(arq.rcvQueue))
+}
+
+// sends the acks, the new segments within the window and the lost ones
+func (arq *udpARQ) flush(now time.Time) {
+	ts := arq.now(now)
+	wnd := arq.wnd()
+
+	for _, ack := range arq.acks {
+		arq.write(&udpSegment{cmd: udpAck, wnd: wnd, ts: ack.ts, sn: ack.sn, una: arq.rcvNxt})
+	}
+	arq.acks = arq.acks[:0]
+
+	// window
+	limit := arq.cwnd
+	if int(arq.rmtWnd) < limit {
+		limit = int(arq.rmtWnd)
+	}
+	if limit < 1 {
+		// probe the window of the peer
+		limit = 1
+	}
+	for len(arq.sndQueue) > 0 && snBefore(arq.sndNxt, arq.sndUna+uint32(limit)) {
+		seg := arq.sndQueue[0]
+		arq.sndQueue[0] = nil
+		arq.sndQueue = arq.sndQueue[1:]
+		seg.sn = arq.sndNxt
+		seg.rto = arq.rto
+		arq.sndNxt++
+		arq.sndBuf = append(arq.sndBuf, seg)
+	}
+
+	lost, resent := false, false
+	for _, seg := range arq.sndBuf {
+		switch {
+		case seg.xmit == 0:
+		case !now.Before(seg.resendAt):
+			lost = true
+			// linear backoff, kind to the latency
+			seg.rto += arq.rto / 2
+			if seg.rto > udpMaxRTO {
+				seg.rto = udpMaxRTO
+			}
+		case seg.fastack >= udpFastResend:
+			resent = true
+			seg.fastack = 0
+		default:
+			continue
+		}
+
+		seg.xmit++
+		if seg.xmit > udpMaxXmit {
+			arq.dead = true
+		}
+		seg.wnd = wnd
+		seg.ts = ts
+		seg.una = arq.rcvNxt
+		seg.resendAt = now.Add(seg.rto)
+		arq.write(seg)
+	}
+
+	// congestion
+	if resent {
+		arq.ssthresh = (len(arq.sndBuf) + 1) / 2
+		if arq.ssthresh < 2 {
+			arq.ssthresh = 2
+		}
+		arq.cwnd = arq.ssthresh + udpFastResend
+		arq.incr = 0
+	}
+	if lost {
+		arq.ssthresh = arq.cwnd / 2
+		if arq.ssthresh < 2 {
+			arq.ssthresh = 2
+		}
+		arq.cwnd = 1
+		arq.incr = 0
+	}
+
+	// keepalive
+	if len(arq.buf) == 0 && now.Sub(arq.lastSend) >= udpPingInterval {
+		arq.write(&udpSegment{cmd: udpPing, wnd: wnd, ts: ts, una: arq.rcvNxt})
+	}
+	arq.emit(now)
+}
+
+// sends a fin right away
+func (arq *udpARQ) close(now time.Time) {
+	arq.write(&udpSegment{cmd: udpFin, wnd: arq.wnd(), ts: arq.now(now), una: arq.rcvNxt})
+	arq.emit(now)
+}
+
+func (arq *udpARQ) write(seg *udpSegment) {
+	if len(arq.buf)+udpHeaderLen+len(seg.data) > udpMTU {
+		arq.emit(time.Now())
+	}
+
+	b := arq.buf
+	b = binary.BigEndian.AppendUint32(b, arq.conv)
+	b = append(b, seg.cmd, seg.frg)
+	b = binary.BigEndian.AppendUint16(b, seg.wnd)
+	b = binary.BigEndian.AppendUint32(b, seg.ts)
+	b = binary.BigEndian.AppendUint32(b, seg.sn)
+	b = binary.BigEndian.AppendUint32(b, seg.una)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(seg.data)))
+	arq.buf = append(b, seg.data...)
+}
+
+func (arq *udpARQ) emit(now time.Time) {
+	if len(arq.buf) == 0 {
+		return
+	}
+	arq.output(arq.buf)
+	arq.buf = arq.buf[:0]
+	arq.lastSend = now
+}
+
+// a hello or cookie datagram
+func udpControl(conv uint32, cmd byte, data []byte) []byte {
+	b := make([]byte, udpHeaderLen, udpHeaderLen+len(data))
+	binary.BigEndian.PutUint32(b, conv)
+	b[4] = cmd
+	binary.BigEndian.PutUint16(b[20:], uint16(len(data)))
+	return append(b, data...)
+}
+
+func parseUDPControl(b []byte) (conv uint32, cmd byte, data []byte, ok bool) {
+	if len(b) < udpHeaderLen {
+		return
+	}
+	conv = binary.BigEndian.Uint32(b)
+	cmd = b[4]
+	if cmd != udpHello && cmd != udpCookie {
+		return
+	}
+	l := int(binary.BigEndian.Uint16(b[20:]))
+	if l != len(b)-udpHeaderLen {
+		return
+	}
+	return conv, cmd, b[udpHeaderLen:], true
+}
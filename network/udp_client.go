@@ -0,0 +1,245 @@
+package network
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/name5566/leaf/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// NewAgent is called once the server accepts the conn by the cookie
+// handshake, the handshake is tried again after ConnectInterval if the
+// server doesn't answer within Timeout
+// MaxMsgLen is at most 128 segments, about 172 KB
+type UDPClient struct {
+	sync.Mutex
+	Addr            string
+	ConnNum         int
+	ConnectInterval time.Duration
+	PendingWriteNum int
+	MaxMsgLen       uint32
+	FirstMsgTimeout time.Duration
+	IdleTimeout     time.Duration
+	Timeout         time.Duration // the conn is closed if the peer sends nothing, pings included
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceKey     func(args [][]byte) string
+	OnOverflow      func(Conn)
+	AutoReconnect   bool
+	NewAgent        func(*UDPConn) Agent
+	conns           map[*UDPConn]struct{}
+	wg              sync.WaitGroup
+	closeFlag       bool
+}
+
+func (client *UDPClient) Start() {
+	client.init()
+
+	for i := 0; i < client.ConnNum; i++ {
+		client.wg.Add(1)
+		go client.connect()
+	}
+}
+
+func (client *UDPClient) init() {
+	client.Lock()
+	defer client.Unlock()
+
+	if client.ConnNum <= 0 {
+		client.ConnNum = 1
+		log.Release("invalid ConnNum, reset to %v", client.ConnNum)
+	}
+	if client.ConnectInterval <= 0 {
+		client.ConnectInterval = 3 * time.Second
+		log.Release("invalid ConnectInterval, reset to %v", client.ConnectInterval)
+	}
+	if client.PendingWriteNum <= 0 {
+		client.PendingWriteNum = 100
+		log.Release("invalid PendingWriteNum, reset to %v", client.PendingWriteNum)
+	}
+	if client.MaxMsgLen <= 0 {
+		client.MaxMsgLen = 4096
+		log.Release("invalid MaxMsgLen, reset to %v", client.MaxMsgLen)
+	} else if client.MaxMsgLen > udpMaxMsgLen {
+		client.MaxMsgLen = udpMaxMsgLen
+		log.Release("invalid MaxMsgLen, reset to %v", client.MaxMsgLen)
+	}
+	if client.Timeout <= 0 {
+		client.Timeout = 10 * time.Second
+		log.Release("invalid Timeout, reset to %v", client.Timeout)
+	}
+	checkOverflow(client.OverflowPolicy, &client.OverflowTimeout)
+	if client.NewAgent == nil {
+		log.Fatal("NewAgent must not be nil")
+	}
+	if client.conns != nil {
+		log.Fatal("client is running")
+	}
+
+	client.conns = make(map[*UDPConn]struct{})
+	client.closeFlag = false
+}
+
+func (client *UDPClient) dial() *net.UDPConn {
+	for {
+		var conn *net.UDPConn
+		addr, err := net.ResolveUDPAddr("udp", client.Addr)
+		if err == nil {
+			conn, err = net.DialUDP("udp", nil, addr)
+		}
+		if err == nil || client.closeFlag {
+			return conn
+		}
+
+		log.Release("connect to %v error: %v", client.Addr, err)
+		time.Sleep(client.ConnectInterval)
+		continue
+	}
+}
+
+func (client *UDPClient) connect() {
+	defer client.wg.Done()
+
+reconnect:
+	conn := client.dial()
+	if conn == nil {
+		return
+	}
+
+	var b [4]byte
+	rand.Read(b[:])
+	conv := binary.BigEndian.Uint32(b[:])
+	if !client.handshake(conn, conv) {
+		conn.Close()
+		if client.closed() {
+			return
+		}
+		time.Sleep(client.ConnectInterval)
+		goto reconnect
+	}
+
+	output := func(b []byte) {
+		conn.Write(b)
+	}
+	udpConn := newUDPConn(conv, conn.LocalAddr(), conn.RemoteAddr(), output, client.PendingWriteNum, client.MaxMsgLen, client.Timeout)
+	udpConn.setReadTimeout(client.FirstMsgTimeout, client.IdleTimeout)
+	udpConn.setOverflow(client.OverflowPolicy, client.OverflowTimeout, client.CoalesceKey, client.OnOverflow)
+	udpConn.onDestroy = func() {
+		conn.Close()
+	}
+
+	client.Lock()
+	if client.closeFlag {
+		client.Unlock()
+		udpConn.Destroy()
+		return
+	}
+	client.conns[udpConn] = struct{}{}
+	client.Unlock()
+
+	go func() {
+		buf := make([]byte, udpMTU)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if udpConn.isDestroyed() {
+					return
+				}
+				// such as connection refused, the conn is closed after Timeout
+				continue
+			}
+			if _, _, _, ok := parseUDPControl(buf[:n]); ok {
+				// a hello resent by the server
+				continue
+			}
+			udpConn.input(buf[:n])
+		}
+	}()
+
+	agent := client.NewAgent(udpConn)
+	agent.Run()
+
+	// cleanup
+	udpConn.Close()
+	<-udpConn.closeChan
+	client.Lock()
+	delete(client.conns, udpConn)
+	client.Unlock()
+	agent.OnClose()
+
+	if client.AutoReconnect {
+		if client.closed() {
+			return
+		}
+
+		time.Sleep(client.ConnectInterval)
+		goto reconnect
+	}
+}
+
+func (client *UDPClient) closed() bool {
+	client.Lock()
+	defer client.Unlock()
+	return client.closeFlag
+}
+
+// sends hellos until the server accepts conv
+func (client *UDPClient) handshake(conn *net.UDPConn, conv uint32) bool {
+	cookie := make([]byte, udpCookieLen)
+	buf := make([]byte, udpMTU)
+	deadline := time.Now().Add(client.Timeout)
+	for time.Now().Before(deadline) && !client.closed() {
+		conn.Write(udpControl(conv, udpHello, cookie))
+		conn.SetReadDeadline(time.Now().Add(udpInitRTO))
+
+	read:
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+					// such as connection refused before the server is up
+					time.Sleep(udpInitRTO)
+				}
+				break
+			}
+
+			c, cmd, data, ok := parseUDPControl(buf[:n])
+			if !ok || c != conv {
+				continue
+			}
+			switch cmd {
+			case udpCookie:
+				if len(data) == udpCookieLen {
+					copy(cookie, data)
+					break read
+				}
+			case udpHello:
+				conn.SetReadDeadline(time.Time{})
+				return true
+			}
+		}
+	}
+
+	if !client.closed() {
+		log.Release("connect to %v error: udp handshake timeout", client.Addr)
+	}
+	return false
+}
+
+func (client *UDPClient) Close() {
+	client.Lock()
+	client.closeFlag = true
+	conns := make([]*UDPConn, 0, len(client.conns))
+	for udpConn := range client.conns {
+		conns = append(conns, udpConn)
+	}
+	client.conns = nil
+	client.Unlock()
+
+	for _, udpConn := range conns {
+		udpConn.Destroy()
+	}
+	client.wg.Wait()
+}
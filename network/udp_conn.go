@@ -0,0 +1,295 @@
+package network
+
+import (
+	"errors"
+	"github.com/name5566/leaf/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+type UDPConn struct {
+	sync.Mutex
+	conv        uint32
+	localAddr   net.Addr
+	remoteAddr  net.Addr
+	arq         *udpARQ
+	queue       *writeQueue
+	sendCond    *sync.Cond // the send queue of the arq has room
+	maxMsgLen   uint32
+	closeFlag   bool // no more writes
+	drained     bool // the write queue is drained after close
+	destroyed   bool
+	closeChan   chan struct{}
+	readNotify  chan struct{}
+	lastRecv    time.Time
+	deadTimeout time.Duration
+	timeout     readTimeout
+	onDestroy   func()
+}
+
+func newUDPConn(conv uint32, localAddr, remoteAddr net.Addr, output func([]byte), pendingWriteNum int, maxMsgLen uint32, deadTimeout time.Duration) *UDPConn {
+	udpConn := new(UDPConn)
+	udpConn.conv = conv
+	udpConn.localAddr = localAddr
+	udpConn.remoteAddr = remoteAddr
+	udpConn.arq = newUDPARQ(conv, output)
+	udpConn.queue = newWriteQueue(pendingWriteNum)
+	udpConn.sendCond = sync.NewCond(udpConn)
+	udpConn.maxMsgLen = maxMsgLen
+	udpConn.closeChan = make(chan struct{})
+	udpConn.readNotify = make(chan struct{}, 1)
+	udpConn.lastRecv = time.Now()
+	udpConn.deadTimeout = deadTimeout
+
+	go udpConn.run()
+	go udpConn.writeLoop()
+
+	return udpConn
+}
+
+// the session id chosen by the client
+func (udpConn *UDPConn) Conv() uint32 {
+	return udpConn.conv
+}
+
+func (udpConn *UDPConn) run() {
+	ticker := time.NewTicker(udpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-udpConn.closeChan:
+			return
+		case now := <-ticker.C:
+			udpConn.Lock()
+			udpConn.update(now)
+			udpConn.Unlock()
+		}
+	}
+}
+
+// moves the messages of the write queue to the arq as its send queue
+// has room, so the write queue overflows if the peer is slow
+func (udpConn *UDPConn) writeLoop() {
+	var items []writeItem
+	for {
+		var ok bool
+		items, ok = udpConn.queue.pop(items[:0])
+		if !ok {
+			return
+		}
+
+		for i := range items {
+			item := items[i]
+			items[i] = writeItem{}
+
+			udpConn.Lock()
+			for len(udpConn.arq.sndQueue) >= udpWnd && !udpConn.destroyed {
+				udpConn.sendCond.Wait()
+			}
+			if udpConn.destroyed {
+				udpConn.Unlock()
+				return
+			}
+			if item.b == nil {
+				udpConn.drained = true
+				if udpConn.arq.idle() {
+					udpConn.doDestroy()
+				}
+				udpConn.Unlock()
+				return
+			}
+			udpConn.arq.send(item.b)
+			udpConn.arq.flush(time.Now())
+			udpConn.Unlock()
+		}
+	}
+}
+
+func (udpConn *UDPConn) update(now time.Time) {
+	if udpConn.destroyed {
+		return
+	}
+	if now.Sub(udpConn.lastRecv) > udpConn.deadTimeout {
+		log.Debug("close conn: udp peer timeout")
+		udpConn.doDestroy()
+		return
+	}
+
+	udpConn.arq.flush(now)
+	udpConn.sendCond.Broadcast()
+	if udpConn.arq.dead {
+		log.Debug("close conn: udp link dead")
+		udpConn.doDestroy()
+		return
+	}
+
+	// the pending data is sent and acked
+	if udpConn.drained && udpConn.arq.idle() {
+		udpConn.doDestroy()
+	}
+}
+
+// called with a datagram of the conn
+func (udpConn *UDPConn) input(b []byte) {
+	udpConn.Lock()
+	defer udpConn.Unlock()
+	if udpConn.destroyed {
+		return
+	}
+
+	now := time.Now()
+	if err := udpConn.arq.input(b, now); err != nil {
+		log.Debug("udp input error: %v", err)
+		return
+	}
+	udpConn.lastRecv = now
+
+	select {
+	case udpConn.readNotify <- struct{}{}:
+	default:
+	}
+
+	if udpConn.arq.fin {
+		udpConn.doDestroy()
+		return
+	}
+	// ack right away for a low latency
+	udpConn.arq.flush(now)
+	udpConn.sendCond.Broadcast()
+}
+
+func (udpConn *UDPConn) doDestroy() {
+	if udpConn.destroyed {
+		return
+	}
+
+	if !udpConn.arq.fin {
+		udpConn.arq.close(time.Now())
+	}
+	udpConn.closeFlag = true
+	udpConn.destroyed = true
+	udpConn.queue.destroy()
+	udpConn.sendCond.Broadcast()
+	close(udpConn.closeChan)
+	if udpConn.onDestroy != nil {
+		udpConn.onDestroy()
+	}
+}
+
+func (udpConn *UDPConn) isDestroyed() bool {
+	udpConn.Lock()
+	defer udpConn.Unlock()
+	return udpConn.destroyed
+}
+
+func (udpConn *UDPConn) Destroy() {
+	udpConn.Lock()
+	defer udpConn.Unlock()
+
+	udpConn.doDestroy()
+}
+
+// the conn is destroyed once the pending data is acked
+func (udpConn *UDPConn) Close() {
+	udpConn.Lock()
+	defer udpConn.Unlock()
+	if udpConn.closeFlag {
+		return
+	}
+
+	udpConn.closeFlag = true
+	if !udpConn.queue.close() {
+		log.Debug("close conn: queue full")
+		udpConn.doDestroy()
+	}
+}
+
+// onOverflow is called by the writing goroutine, it must not write to the conn
+func (udpConn *UDPConn) setOverflow(policy OverflowPolicy, timeout time.Duration, key func(args [][]byte) string, onOverflow func(Conn)) {
+	udpConn.queue.overflow = overflow{policy: policy, timeout: timeout, key: key, onOverflow: onOverflow}
+}
+
+func (udpConn *UDPConn) LocalAddr() net.Addr {
+	return udpConn.localAddr
+}
+
+func (udpConn *UDPConn) RemoteAddr() net.Addr {
+	return udpConn.remoteAddr
+}
+
+func (udpConn *UDPConn) setReadTimeout(firstMsgTimeout, idleTimeout time.Duration) {
+	udpConn.timeout.firstMsgTimeout = firstMsgTimeout
+	udpConn.timeout.idleTimeout = idleTimeout
+}
+
+// goroutine not safe
+func (udpConn *UDPConn) ReadMsg() ([]byte, error) {
+	var deadline <-chan time.Time
+	if d := udpConn.timeout.deadline(); !d.IsZero() {
+		timer := time.NewTimer(time.Until(d))
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	for {
+		udpConn.Lock()
+		b, ok := udpConn.arq.recv()
+		destroyed := udpConn.destroyed
+		udpConn.Unlock()
+		if ok {
+			udpConn.timeout.checkErr(nil)
+			return b, nil
+		}
+		if destroyed {
+			return nil, io.EOF
+		}
+
+		select {
+		case <-udpConn.readNotify:
+		case <-udpConn.closeChan:
+		case <-deadline:
+			return nil, ErrReadTimeout
+		}
+	}
+}
+
+func (udpConn *UDPConn) WriteMsg(args ...[]byte) error {
+	udpConn.Lock()
+	closeFlag := udpConn.closeFlag
+	udpConn.Unlock()
+	if closeFlag {
+		return nil
+	}
+
+	// get len
+	var msgLen uint32
+	for i := 0; i < len(args); i++ {
+		msgLen += uint32(len(args[i]))
+	}
+
+	// check len
+	if msgLen > udpConn.maxMsgLen {
+		return errors.New("message too long")
+	} else if msgLen < 1 {
+		return errors.New("message too short")
+	}
+
+	key := udpConn.queue.msgKey(args)
+
+	// merge the args, the message is kept by the arq
+	msg := make([]byte, msgLen)
+	l := 0
+	for i := 0; i < len(args); i++ {
+		copy(msg[l:], args[i])
+		l += len(args[i])
+	}
+
+	// the conn is not locked for the overflow policy, Block may wait
+	if !udpConn.queue.push(udpConn, writeItem{b: msg, key: key}) {
+		udpConn.Destroy()
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package network
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"github.com/name5566/leaf/log"
+	"net"
+	"sync"
+	"time"
+)
+
+// MaxMsgLen is at most 128 segments, about 172 KB
+type UDPServer struct {
+	Addr            string
+	MaxConnNum      int
+	PendingWriteNum int
+	MaxMsgLen       uint32
+	FirstMsgTimeout time.Duration
+	IdleTimeout     time.Duration
+	Timeout         time.Duration // the conn is closed if the peer sends nothing, pings included
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceKey     func(args [][]byte) string
+	OnOverflow      func(Conn)
+	NewAgent        func(*UDPConn) Agent
+	OnDrain         func(Agent)
+	pc              net.PacketConn
+	secret          [32]byte // of the cookies
+	conns           map[uint32]*UDPConn
+	agents          map[Agent]struct{}
+	draining        bool
+	mutexConns      sync.Mutex
+	wgLn            sync.WaitGroup
+	wgConns         sync.WaitGroup
+}
+
+func (server *UDPServer) Start() {
+	server.init()
+	go server.run()
+}
+
+func (server *UDPServer) init() {
+	pc, err := net.ListenPacket("udp", server.Addr)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
+
+	if server.MaxConnNum <= 0 {
+		server.MaxConnNum = 100
+		log.Release("invalid MaxConnNum, reset to %v", server.MaxConnNum)
+	}
+	if server.PendingWriteNum <= 0 {
+		server.PendingWriteNum = 100
+		log.Release("invalid PendingWriteNum, reset to %v", server.PendingWriteNum)
+	}
+	if server.MaxMsgLen <= 0 {
+		server.MaxMsgLen = 4096
+		log.Release("invalid MaxMsgLen, reset to %v", server.MaxMsgLen)
+	} else if server.MaxMsgLen > udpMaxMsgLen {
+		server.MaxMsgLen = udpMaxMsgLen
+		log.Release("invalid MaxMsgLen, reset to %v", server.MaxMsgLen)
+	}
+	if server.Timeout <= 0 {
+		server.Timeout = 10 * time.Second
+		log.Release("invalid Timeout, reset to %v", server.Timeout)
+	}
+	checkOverflow(server.OverflowPolicy, &server.OverflowTimeout)
+	if server.NewAgent == nil {
+		log.Fatal("NewAgent must not be nil")
+	}
+
+	server.pc = pc
+	rand.Read(server.secret[:])
+	server.conns = make(map[uint32]*UDPConn)
+	server.agents = make(map[Agent]struct{})
+	server.draining = false
+}
+
+func (server *UDPServer) run() {
+	server.wgLn.Add(1)
+	defer server.wgLn.Done()
+
+	buf := make([]byte, udpMTU)
+	for {
+		n, addr, err := server.pc.ReadFrom(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		if n < udpHeaderLen {
+			continue
+		}
+
+		if conv, cmd, cookie, ok := parseUDPControl(buf[:n]); ok {
+			if cmd == udpHello {
+				server.hello(conv, cookie, addr)
+			}
+			continue
+		}
+
+		conv := binary.BigEndian.Uint32(buf)
+		server.mutexConns.Lock()
+		udpConn := server.conns[conv]
+		server.mutexConns.Unlock()
+		// no migration, a session belongs to its first address
+		if udpConn != nil && udpConn.remoteAddr.String() == addr.String() {
+			udpConn.input(buf[:n])
+		}
+	}
+}
+
+// the cookie of a conv from an address in an epoch
+func (server *UDPServer) cookie(conv uint32, addr net.Addr, epoch int64) []byte {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:], conv)
+	binary.BigEndian.PutUint64(b[4:], uint64(epoch))
+	h := hmac.New(sha256.New, server.secret[:])
+	h.Write(b[:])
+	h.Write([]byte(addr.String()))
+	return h.Sum(nil)[:udpCookieLen]
+}
+
+// a hello with no valid cookie gets a cookie, a conn is only created for
+// a peer which receives at its address
+func (server *UDPServer) hello(conv uint32, cookie []byte, addr net.Addr) {
+	if len(cookie) != udpCookieLen {
+		return
+	}
+
+	epoch := time.Now().UnixNano() / int64(udpCookieEpoch)
+	if !hmac.Equal(cookie, server.cookie(conv, addr, epoch)) &&
+		!hmac.Equal(cookie, server.cookie(conv, addr, epoch-1)) {
+		if !bytes.Equal(cookie, make([]byte, udpCookieLen)) {
+			log.Debug("invalid udp cookie from %v", addr)
+		}
+		server.pc.WriteTo(udpControl(conv, udpCookie, server.cookie(conv, addr, epoch)), addr)
+		return
+	}
+
+	if server.conn(conv, addr) != nil {
+		// accepted, again if the accept is lost
+		server.pc.WriteTo(udpControl(conv, udpHello, nil), addr)
+	}
+}
+
+// returns the conn of conv, a new one if none
+func (server *UDPServer) conn(conv uint32, addr net.Addr) *UDPConn {
+	server.mutexConns.Lock()
+	defer server.mutexConns.Unlock()
+
+	udpConn, ok := server.conns[conv]
+	if ok {
+		if udpConn.remoteAddr.String() != addr.String() {
+			return nil
+		}
+		return udpConn
+	}
+	if server.conns == nil || server.draining {
+		return nil
+	}
+	if len(server.conns) >= server.MaxConnNum {
+		log.Debug("too many connections")
+		return nil
+	}
+
+	output := func(b []byte) {
+		server.pc.WriteTo(b, addr)
+	}
+	udpConn = newUDPConn(conv, server.pc.LocalAddr(), addr, output, server.PendingWriteNum, server.MaxMsgLen, server.Timeout)
+	udpConn.setReadTimeout(server.FirstMsgTimeout, server.IdleTimeout)
+	udpConn.setOverflow(server.OverflowPolicy, server.OverflowTimeout, server.CoalesceKey, server.OnOverflow)
+	udpConn.onDestroy = func() {
+		server.mutexConns.Lock()
+		if server.conns[conv] == udpConn {
+			delete(server.conns, conv)
+		}
+		server.mutexConns.Unlock()
+	}
+	server.conns[conv] = udpConn
+
+	server.wgConns.Add(1)
+	go func() {
+		agent := server.newAgent(udpConn)
+		if agent != nil {
+			agent.Run()
+		}
+
+		// cleanup
+		udpConn.Close()
+		server.mutexConns.Lock()
+		delete(server.agents, agent)
+		server.mutexConns.Unlock()
+		if agent != nil {
+			agent.OnClose()
+		}
+
+		server.wgConns.Done()
+	}()
+
+	return udpConn
+}
+
+// returns nil once draining, the agent is drained here if Drain starts
+// while it's created
+func (server *UDPServer) newAgent(udpConn *UDPConn) Agent {
+	server.mutexConns.Lock()
+	draining := server.draining
+	server.mutexConns.Unlock()
+	if draining {
+		return nil
+	}
+
+	agent := server.NewAgent(udpConn)
+	server.mutexConns.Lock()
+	server.agents[agent] = struct{}{}
+	draining = server.draining
+	server.mutexConns.Unlock()
+	if draining && server.OnDrain != nil {
+		server.OnDrain(agent)
+	}
+	return agent
+}
+
+func (server *UDPServer) Close() {
+	server.mutexConns.Lock()
+	conns := make([]*UDPConn, 0, len(server.conns))
+	for _, udpConn := range server.conns {
+		conns = append(conns, udpConn)
+	}
+	server.conns = nil
+	server.mutexConns.Unlock()
+
+	for _, udpConn := range conns {
+		udpConn.Destroy()
+	}
+	server.wgConns.Wait()
+
+	server.pc.Close()
+	server.wgLn.Wait()
+}
+
+// Drain stops accepting, calls OnDrain for every live agent, waits up to
+// timeout for the agents to disconnect and then closes the rest
+func (server *UDPServer) Drain(timeout time.Duration) {
+	server.mutexConns.Lock()
+	server.draining = true
+	agents := make([]Agent, 0, len(server.agents))
+	for agent := range server.agents {
+		agents = append(agents, agent)
+	}
+	server.mutexConns.Unlock()
+
+	if server.OnDrain != nil {
+		for _, agent := range agents {
+			server.OnDrain(agent)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.wgConns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		server.mutexConns.Lock()
+		log.Release("drain timeout, close %v connections", len(server.conns))
+		server.mutexConns.Unlock()
+	}
+
+	server.Close()
+}
@@ -0,0 +1,300 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+type udpEchoAgent struct {
+	conn *UDPConn
+}
+
+func (a *udpEchoAgent) Run() {
+	for {
+		data, err := a.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		a.conn.WriteMsg(data)
+	}
+}
+
+func (a *udpEchoAgent) OnClose() {}
+
+func TestUDP(t *testing.T) {
+	server := &UDPServer{
+		Addr:      "127.0.0.1:0",
+		MaxMsgLen: 64 * 1024,
+		NewAgent: func(conn *UDPConn) Agent {
+			return &udpEchoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conns := make(chan *UDPConn, 1)
+	done := make(chan struct{})
+	client := &UDPClient{
+		Addr:      server.pc.LocalAddr().String(),
+		MaxMsgLen: 64 * 1024,
+		NewAgent: func(conn *UDPConn) Agent {
+			conns <- conn
+			return &loopbackFunc{run: func() { <-done }}
+		},
+	}
+	client.Start()
+	defer client.Close()
+	defer close(done)
+
+	conn := <-conns
+	msgs := [][]byte{[]byte("hello"), bytes.Repeat([]byte("leaf"), 10000)}
+	for i := 0; i < 50; i++ {
+		msgs = append(msgs, []byte(fmt.Sprint(i)))
+	}
+	for _, msg := range msgs {
+		if err := conn.WriteMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.setReadTimeout(0, 3*time.Second)
+	for _, msg := range msgs {
+		data, err := conn.ReadMsg()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, msg) {
+			t.Fatalf("got %v bytes, want %v", len(data), len(msg))
+		}
+	}
+}
+
+type loopbackFunc struct {
+	run func()
+}
+
+func (a *loopbackFunc) Run()     { a.run() }
+func (a *loopbackFunc) OnClose() {}
+
+// two arqs linked by a lossy, reordering link
+type udpLink struct {
+	r        *rand.Rand
+	a, b     *udpARQ
+	inflight []func()
+}
+
+func newUDPLink(seed int64) *udpLink {
+	l := &udpLink{r: rand.New(rand.NewSource(seed))}
+	l.a = newUDPARQ(1, l.output(&l.b))
+	l.b = newUDPARQ(1, l.output(&l.a))
+	return l
+}
+
+func (l *udpLink) output(to **udpARQ) func([]byte) {
+	return func(p []byte) {
+		if l.r.Intn(100) < 10 {
+			return
+		}
+		p = append([]byte(nil), p...)
+		l.inflight = append(l.inflight, func() {
+			(*to).input(p, time.Now())
+		})
+	}
+}
+
+// runs the link until n messages are received by b or timeout
+func (l *udpLink) recv(n int, timeout time.Duration) [][]byte {
+	var got [][]byte
+	deadline := time.Now().Add(timeout)
+	for len(got) < n && time.Now().Before(deadline) {
+		now := time.Now()
+		l.a.flush(now)
+		l.b.flush(now)
+		pending := l.inflight
+		l.inflight = nil
+		l.r.Shuffle(len(pending), func(i, j int) {
+			pending[i], pending[j] = pending[j], pending[i]
+		})
+		for _, f := range pending {
+			f()
+		}
+		for {
+			msg, ok := l.b.recv()
+			if !ok {
+				break
+			}
+			got = append(got, msg)
+		}
+		time.Sleep(udpInterval)
+	}
+	return got
+}
+
+func TestUDPARQLoss(t *testing.T) {
+	l := newUDPLink(1)
+
+	var sent [][]byte
+	for i := 0; i < 100; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, l.r.Intn(3*udpMSS)+1)
+		sent = append(sent, msg)
+		l.a.send(msg)
+	}
+
+	got := l.recv(len(sent), 10*time.Second)
+	if len(got) != len(sent) {
+		t.Fatalf("got %v messages, want %v", len(got), len(sent))
+	}
+	for i := range sent {
+		if !bytes.Equal(got[i], sent[i]) {
+			t.Fatalf("message %v mismatch", i)
+		}
+	}
+	if l.a.dead || l.b.dead {
+		t.Fatal("link dead")
+	}
+}
+
+// a message of the whole receive window
+func TestUDPARQLargeMessage(t *testing.T) {
+	l := newUDPLink(2)
+
+	if err := l.a.send(make([]byte, udpMaxMsgLen+1)); err == nil {
+		t.Fatal("message longer than the window sent")
+	}
+
+	sent := make([]byte, udpMaxMsgLen)
+	l.r.Read(sent)
+	if err := l.a.send(sent); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.a.send([]byte("next")); err != nil {
+		t.Fatal(err)
+	}
+
+	got := l.recv(2, 20*time.Second)
+	if len(got) != 2 {
+		t.Fatalf("got %v messages, want 2", len(got))
+	}
+	if !bytes.Equal(got[0], sent) || string(got[1]) != "next" {
+		t.Fatal("message mismatch")
+	}
+}
+
+func readUDPControl(t *testing.T, conn *net.UDPConn) (byte, []byte) {
+	buf := make([]byte, udpMTU)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, cmd, data, ok := parseUDPControl(buf[:n]); ok {
+			return cmd, append([]byte(nil), data...)
+		}
+	}
+}
+
+func TestUDPCookie(t *testing.T) {
+	server := &UDPServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *UDPConn) Agent {
+			return &udpEchoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.DialUDP("udp", nil, server.pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	numConns := func() int {
+		server.mutexConns.Lock()
+		defer server.mutexConns.Unlock()
+		return len(server.conns)
+	}
+
+	// no session without a hello
+	ping := udpControl(7, udpPing, nil)
+	conn.Write(ping)
+
+	conn.Write(udpControl(7, udpHello, make([]byte, udpCookieLen)))
+	cmd, cookie := readUDPControl(t, conn)
+	if cmd != udpCookie || len(cookie) != udpCookieLen {
+		t.Fatalf("got cmd %v, want a cookie", cmd)
+	}
+
+	// the cookie is bound to the conv
+	conn.Write(udpControl(8, udpHello, cookie))
+	if cmd, _ := readUDPControl(t, conn); cmd != udpCookie {
+		t.Fatalf("got cmd %v for a wrong cookie", cmd)
+	}
+	if n := numConns(); n != 0 {
+		t.Fatalf("%v conns before the handshake", n)
+	}
+
+	conn.Write(udpControl(7, udpHello, cookie))
+	if cmd, _ := readUDPControl(t, conn); cmd != udpHello {
+		t.Fatalf("got cmd %v, want an accept", cmd)
+	}
+	// the accept is resent for a hello lost
+	conn.Write(udpControl(7, udpHello, cookie))
+	if cmd, _ := readUDPControl(t, conn); cmd != udpHello {
+		t.Fatalf("got cmd %v, want an accept", cmd)
+	}
+	if n := numConns(); n != 1 {
+		t.Fatalf("%v conns after the handshake", n)
+	}
+}
+
+// the peer never acks, so the write queue overflows
+func TestUDPOverflow(t *testing.T) {
+	conns := make(chan *UDPConn, 1)
+	overflowed := make(chan struct{}, 1)
+	server := &UDPServer{
+		Addr:            "127.0.0.1:0",
+		PendingWriteNum: 4,
+		OnOverflow: func(Conn) {
+			select {
+			case overflowed <- struct{}{}:
+			default:
+			}
+		},
+		NewAgent: func(conn *UDPConn) Agent {
+			conns <- conn
+			return &udpEchoAgent{conn: conn}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	conn, err := net.DialUDP("udp", nil, server.pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(udpControl(7, udpHello, make([]byte, udpCookieLen)))
+	_, cookie := readUDPControl(t, conn)
+	conn.Write(udpControl(7, udpHello, cookie))
+	readUDPControl(t, conn)
+
+	udpConn := <-conns
+	for i := 0; i < 2*udpWnd && !udpConn.isDestroyed(); i++ {
+		udpConn.WriteMsg([]byte("leaf"))
+	}
+	select {
+	case <-overflowed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("OnOverflow not called")
+	}
+	select {
+	case <-udpConn.closeChan:
+	case <-time.After(3 * time.Second):
+		t.Fatal("conn not destroyed")
+	}
+}
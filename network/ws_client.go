@@ -15,12 +15,24 @@ type WSClient struct {
 	PendingWriteNum  int
 	MaxMsgLen        uint32
 	HandshakeTimeout time.Duration
+	PingInterval     time.Duration
+	PongWait         time.Duration
+	Subprotocols     []string
+	TextMessage      bool
+	OverflowPolicy   OverflowPolicy
+	OverflowTimeout  time.Duration
+	CoalesceKey      func(args [][]byte) string
+	OnOverflow       func(Conn)
 	AutoReconnect    bool
 	NewAgent         func(*WSConn) Agent
 	dialer           websocket.Dialer
 	conns            WebsocketConnSet
 	wg               sync.WaitGroup
 	closeFlag        bool
+
+	// permessage-deflate, messages shorter than CompressThreshold are not compressed
+	EnableCompression bool
+	CompressThreshold int
 }
 
 func (client *WSClient) Start() {
@@ -56,6 +68,8 @@ func (client *WSClient) init() {
 		client.HandshakeTimeout = 10 * time.Second
 		log.Release("invalid HandshakeTimeout, reset to %v", client.HandshakeTimeout)
 	}
+	checkOverflow(client.OverflowPolicy, &client.OverflowTimeout)
+	checkPing(client.PingInterval, &client.PongWait)
 	if client.NewAgent == nil {
 		log.Fatal("NewAgent must not be nil")
 	}
@@ -66,7 +80,9 @@ func (client *WSClient) init() {
 	client.conns = make(WebsocketConnSet)
 	client.closeFlag = false
 	client.dialer = websocket.Dialer{
-		HandshakeTimeout: client.HandshakeTimeout,
+		HandshakeTimeout:  client.HandshakeTimeout,
+		Subprotocols:      client.Subprotocols,
+		EnableCompression: client.EnableCompression,
 	}
 }
 
@@ -102,7 +118,10 @@ reconnect:
 	client.conns[conn] = struct{}{}
 	client.Unlock()
 
-	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen)
+	wsConn := newWSConn(conn, client.PendingWriteNum, client.MaxMsgLen, client.TextMessage)
+	wsConn.setPing(client.PingInterval, client.PongWait)
+	wsConn.setCompression(client.CompressThreshold)
+	wsConn.setOverflow(client.OverflowPolicy, client.OverflowTimeout, client.CoalesceKey, client.OnOverflow)
 	agent := client.NewAgent(wsConn)
 	agent.Run()
 
@@ -114,6 +133,13 @@ reconnect:
 	agent.OnClose()
 
 	if client.AutoReconnect {
+		client.Lock()
+		closeFlag := client.closeFlag
+		client.Unlock()
+		if closeFlag {
+			return
+		}
+
 		time.Sleep(client.ConnectInterval)
 		goto reconnect
 	}
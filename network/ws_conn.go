@@ -6,6 +6,7 @@ import (
 	"github.com/name5566/leaf/log"
 	"net"
 	"sync"
+	"time"
 )
 
 type WebsocketConnSet map[*websocket.Conn]struct{}
@@ -13,46 +14,137 @@ type WebsocketConnSet map[*websocket.Conn]struct{}
 type WSConn struct {
 	sync.Mutex
 	conn      *websocket.Conn
-	writeChan chan []byte
+	msgType   int // frame type of WriteMsg
+	queue     *writeQueue
 	maxMsgLen uint32
 	closeFlag bool
+	closeChan chan struct{}
+	timeout   readTimeout
+
+	// messages shorter than compressThreshold are not compressed
+	compressThreshold int
+
+	// ping
+	pongWait    time.Duration
+	lastRecv    time.Time
+	msgDeadline time.Time
 }
 
-func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32) *WSConn {
+func newWSConn(conn *websocket.Conn, pendingWriteNum int, maxMsgLen uint32, textMessage bool) *WSConn {
 	wsConn := new(WSConn)
 	wsConn.conn = conn
-	wsConn.writeChan = make(chan []byte, pendingWriteNum)
+	wsConn.msgType = websocket.BinaryMessage
+	if textMessage {
+		wsConn.msgType = websocket.TextMessage
+	}
+	wsConn.queue = newWriteQueue(pendingWriteNum)
 	wsConn.maxMsgLen = maxMsgLen
+	wsConn.closeChan = make(chan struct{})
 
 	go func() {
-		for b := range wsConn.writeChan {
-			if b == nil {
+		var items []writeItem
+	loop:
+		for {
+			var ok bool
+			items, ok = wsConn.queue.pop(items[:0])
+			if !ok {
 				break
 			}
 
-			err := conn.WriteMessage(websocket.BinaryMessage, b)
-			if err != nil {
-				break
+			for i := range items {
+				item := items[i]
+				items[i] = writeItem{}
+				if item.b == nil {
+					break loop
+				}
+
+				if wsConn.compressThreshold > 0 {
+					conn.EnableWriteCompression(len(item.b) >= wsConn.compressThreshold)
+				}
+				msgType := item.msgType
+				if msgType == 0 {
+					msgType = wsConn.msgType
+				}
+				err := conn.WriteMessage(msgType, item.b)
+				if err != nil {
+					break loop
+				}
 			}
 		}
 
 		conn.Close()
+		wsConn.queue.destroy()
 		wsConn.Lock()
 		wsConn.closeFlag = true
 		wsConn.Unlock()
+		close(wsConn.closeChan)
 	}()
 
 	return wsConn
 }
 
+// a pong comes after the ping, so pongWait must be longer than pingInterval,
+// it's required too or a dead peer is pinged forever
+func checkPing(pingInterval time.Duration, pongWait *time.Duration) {
+	if pingInterval > 0 && *pongWait <= pingInterval {
+		*pongWait = 2 * pingInterval
+		log.Release("invalid PongWait, reset to %v", *pongWait)
+	}
+}
+
+// the conn is closed if the peer sends nothing, pong included, within pongWait
+func (wsConn *WSConn) setPing(pingInterval, pongWait time.Duration) {
+	if pingInterval <= 0 {
+		return
+	}
+
+	wsConn.pongWait = pongWait
+	wsConn.lastRecv = time.Now()
+	if pongWait > 0 {
+		wsConn.conn.SetReadDeadline(wsConn.readDeadline())
+		wsConn.conn.SetPongHandler(func(string) error {
+			wsConn.lastRecv = time.Now()
+			return wsConn.conn.SetReadDeadline(wsConn.readDeadline())
+		})
+	}
+
+	go func() {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-wsConn.closeChan:
+				return
+			case <-ticker.C:
+				err := wsConn.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingInterval))
+				if err != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (wsConn *WSConn) readDeadline() time.Time {
+	d := wsConn.msgDeadline
+	if wsConn.pongWait > 0 {
+		p := wsConn.lastRecv.Add(wsConn.pongWait)
+		if d.IsZero() || p.Before(d) {
+			d = p
+		}
+	}
+	return d
+}
+
 func (wsConn *WSConn) doDestroy() {
-	wsConn.conn.UnderlyingConn().(*net.TCPConn).SetLinger(0)
+	if c, ok := rawTCPConn(wsConn.conn.UnderlyingConn()); ok {
+		c.SetLinger(0)
+	}
 	wsConn.conn.Close()
 
-	if !wsConn.closeFlag {
-		close(wsConn.writeChan)
-		wsConn.closeFlag = true
-	}
+	wsConn.queue.destroy()
+	wsConn.closeFlag = true
 }
 
 func (wsConn *WSConn) Destroy() {
@@ -69,18 +161,33 @@ func (wsConn *WSConn) Close() {
 		return
 	}
 
-	wsConn.doWrite(nil)
+	if !wsConn.queue.close() {
+		log.Debug("close conn: queue full")
+		wsConn.doDestroy()
+	}
 	wsConn.closeFlag = true
 }
 
-func (wsConn *WSConn) doWrite(b []byte) {
-	if len(wsConn.writeChan) == cap(wsConn.writeChan) {
-		log.Debug("close conn: channel full")
-		wsConn.doDestroy()
-		return
+func (wsConn *WSConn) doWrite(item writeItem) {
+	// the conn is not locked for the overflow policy, Block may wait
+	if !wsConn.queue.push(wsConn, item) {
+		wsConn.Destroy()
 	}
+}
 
-	wsConn.writeChan <- b
+// onOverflow is called by the writing goroutine, it must not write to the conn
+func (wsConn *WSConn) setOverflow(policy OverflowPolicy, timeout time.Duration, key func(args [][]byte) string, onOverflow func(Conn)) {
+	wsConn.queue.overflow = overflow{policy: policy, timeout: timeout, key: key, onOverflow: onOverflow}
+}
+
+// works only if permessage-deflate is negotiated in the handshake
+func (wsConn *WSConn) setCompression(threshold int) {
+	wsConn.compressThreshold = threshold
+}
+
+// the subprotocol negotiated in the handshake
+func (wsConn *WSConn) Subprotocol() string {
+	return wsConn.conn.Subprotocol()
 }
 
 func (wsConn *WSConn) LocalAddr() net.Addr {
@@ -91,17 +198,53 @@ func (wsConn *WSConn) RemoteAddr() net.Addr {
 	return wsConn.conn.RemoteAddr()
 }
 
+func (wsConn *WSConn) setReadTimeout(firstMsgTimeout, idleTimeout time.Duration) {
+	wsConn.timeout.firstMsgTimeout = firstMsgTimeout
+	wsConn.timeout.idleTimeout = idleTimeout
+}
+
 // goroutine not safe
 func (wsConn *WSConn) ReadMsg() ([]byte, error) {
-	_, b, err := wsConn.conn.ReadMessage()
+	_, b, err := wsConn.ReadMessage()
 	return b, err
 }
 
+// goroutine not safe
+// ReadMessage returns the frame type, websocket.TextMessage or
+// websocket.BinaryMessage, with the message
+func (wsConn *WSConn) ReadMessage() (int, []byte, error) {
+	if wsConn.timeout.enabled() || wsConn.pongWait > 0 {
+		wsConn.msgDeadline = wsConn.timeout.deadline()
+		wsConn.conn.SetReadDeadline(wsConn.readDeadline())
+	}
+	msgType, b, err := wsConn.conn.ReadMessage()
+	if err == nil {
+		wsConn.lastRecv = time.Now()
+	}
+	return msgType, b, wsConn.timeout.checkErr(err)
+}
+
 // args must not be modified by the others goroutines
+// the frame type is text if TextMessage is set, binary otherwise
 func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
+	return wsConn.write(0, args)
+}
+
+// args must not be modified by the others goroutines
+// WriteMessage writes a frame of msgType, websocket.TextMessage or
+// websocket.BinaryMessage, whatever TextMessage is
+func (wsConn *WSConn) WriteMessage(msgType int, args ...[]byte) error {
+	if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
+		return errors.New("invalid websocket message type")
+	}
+	return wsConn.write(msgType, args)
+}
+
+func (wsConn *WSConn) write(msgType int, args [][]byte) error {
 	wsConn.Lock()
-	defer wsConn.Unlock()
-	if wsConn.closeFlag {
+	closeFlag := wsConn.closeFlag
+	wsConn.Unlock()
+	if closeFlag {
 		return nil
 	}
 
@@ -118,9 +261,11 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 		return errors.New("message too short")
 	}
 
+	key := wsConn.queue.msgKey(args)
+
 	// don't copy
 	if len(args) == 1 {
-		wsConn.doWrite(args[0])
+		wsConn.doWrite(writeItem{b: args[0], key: key, msgType: msgType})
 		return nil
 	}
 
@@ -132,7 +277,7 @@ func (wsConn *WSConn) WriteMsg(args ...[]byte) error {
 		l += len(args[i])
 	}
 
-	wsConn.doWrite(msg)
+	wsConn.doWrite(writeItem{b: msg, key: key, msgType: msgType})
 
 	return nil
 }
@@ -1,9 +1,11 @@
 package network
 
 import (
+	"context"
 	"crypto/tls"
 	"github.com/gorilla/websocket"
 	"github.com/name5566/leaf/log"
+	"math"
 	"net"
 	"net/http"
 	"sync"
@@ -16,22 +18,66 @@ type WSServer struct {
 	PendingWriteNum int
 	MaxMsgLen       uint32
 	HTTPTimeout     time.Duration
+	FirstMsgTimeout time.Duration
+	IdleTimeout     time.Duration
+	KeepAlive       time.Duration
+	PingInterval    time.Duration
+	PongWait        time.Duration
+	Subprotocols    []string
+	TextMessage     bool
+	OverflowPolicy  OverflowPolicy
+	OverflowTimeout time.Duration
+	CoalesceKey     func(args [][]byte) string
+	OnOverflow      func(Conn)
 	CertFile        string
 	KeyFile         string
 	NewAgent        func(*WSConn) Agent
+	OnDrain         func(Agent)
 	ln              net.Listener
 	handler         *WSHandler
+
+	// permessage-deflate, messages shorter than CompressThreshold are not compressed
+	EnableCompression bool
+	CompressThreshold int
+
+	// connection limits, zero means no limit
+	// AllowCIDRs and DenyCIDRs take networks or single ips, for example
+	// "10.0.0.0/8" or "192.168.1.1", only AllowCIDRs may connect if not empty;
+	// denied requests get 403 and the ones over the limits 429
+	MaxConnPerIP int
+	AcceptRate   float64 // new connections per second
+	AcceptBurst  int
+	AllowCIDRs   []string
+	DenyCIDRs    []string
+	// the ip the limits apply to, with or without a port, r.RemoteAddr if nil;
+	// behind a proxy it may be taken from a header the proxy sets, such as
+	// X-Forwarded-For, which must not be trusted otherwise
+	ClientIP func(r *http.Request) string
+	limiter  *connLimiter
 }
 
 type WSHandler struct {
 	maxConnNum      int
 	pendingWriteNum int
 	maxMsgLen       uint32
+	firstMsgTimeout time.Duration
+	idleTimeout     time.Duration
+	pingInterval    time.Duration
+	pongWait        time.Duration
+	textMessage     bool
+	overflow        overflow
 	newAgent        func(*WSConn) Agent
+	onDrain         func(Agent)
 	upgrader        websocket.Upgrader
 	conns           WebsocketConnSet
+	agents          map[Agent]struct{}
+	draining        bool
 	mutexConns      sync.Mutex
 	wg              sync.WaitGroup
+
+	compressThreshold int
+	limiter           *connLimiter
+	clientIP          func(r *http.Request) string
 }
 
 func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -39,6 +85,33 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Method not allowed", 405)
 		return
 	}
+
+	// the upgrades in flight are waited for by Drain and Close
+	handler.mutexConns.Lock()
+	if handler.conns == nil || handler.draining {
+		handler.mutexConns.Unlock()
+		http.Error(w, "Service Unavailable", 503)
+		return
+	}
+	handler.wg.Add(1)
+	handler.mutexConns.Unlock()
+	defer handler.wg.Done()
+
+	addr := r.RemoteAddr
+	if handler.clientIP != nil {
+		addr = handler.clientIP(r)
+	}
+	ip, err := handler.limiter.acquire(addr)
+	if err == errDenied {
+		http.Error(w, "Forbidden", 403)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Too Many Requests", 429)
+		return
+	}
+	defer handler.limiter.release(ip)
+
 	conn, err := handler.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Debug("upgrade error: %v", err)
@@ -46,9 +119,6 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	conn.SetReadLimit(int64(handler.maxMsgLen))
 
-	handler.wg.Add(1)
-	defer handler.wg.Done()
-
 	handler.mutexConns.Lock()
 	if handler.conns == nil {
 		handler.mutexConns.Unlock()
@@ -58,26 +128,57 @@ func (handler *WSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if len(handler.conns) >= handler.maxConnNum {
 		handler.mutexConns.Unlock()
 		conn.Close()
-		log.Debug("too many connections")
+		handler.limiter.rejectMaxConn()
 		return
 	}
 	handler.conns[conn] = struct{}{}
 	handler.mutexConns.Unlock()
 
-	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen)
-	agent := handler.newAgent(wsConn)
-	agent.Run()
+	wsConn := newWSConn(conn, handler.pendingWriteNum, handler.maxMsgLen, handler.textMessage)
+	wsConn.setReadTimeout(handler.firstMsgTimeout, handler.idleTimeout)
+	wsConn.setPing(handler.pingInterval, handler.pongWait)
+	wsConn.setCompression(handler.compressThreshold)
+	wsConn.setOverflow(handler.overflow.policy, handler.overflow.timeout, handler.overflow.key, handler.overflow.onOverflow)
+	agent := handler.createAgent(wsConn)
+	if agent != nil {
+		agent.Run()
+	}
 
 	// cleanup
 	wsConn.Close()
 	handler.mutexConns.Lock()
 	delete(handler.conns, conn)
+	delete(handler.agents, agent)
 	handler.mutexConns.Unlock()
-	agent.OnClose()
+	if agent != nil {
+		agent.OnClose()
+	}
+}
+
+// returns nil once draining, the agent is drained here if Drain starts
+// while it's created
+func (handler *WSHandler) createAgent(wsConn *WSConn) Agent {
+	handler.mutexConns.Lock()
+	draining := handler.draining
+	handler.mutexConns.Unlock()
+	if draining {
+		return nil
+	}
+
+	agent := handler.newAgent(wsConn)
+	handler.mutexConns.Lock()
+	handler.agents[agent] = struct{}{}
+	draining = handler.draining
+	handler.mutexConns.Unlock()
+	if draining && handler.onDrain != nil {
+		handler.onDrain(agent)
+	}
+	return agent
 }
 
 func (server *WSServer) Start() {
-	ln, err := net.Listen("tcp", server.Addr)
+	lc := net.ListenConfig{KeepAlive: server.KeepAlive}
+	ln, err := lc.Listen(context.Background(), "tcp", server.Addr)
 	if err != nil {
 		log.Fatal("%v", err)
 	}
@@ -98,6 +199,16 @@ func (server *WSServer) Start() {
 		server.HTTPTimeout = 10 * time.Second
 		log.Release("invalid HTTPTimeout, reset to %v", server.HTTPTimeout)
 	}
+	checkOverflow(server.OverflowPolicy, &server.OverflowTimeout)
+	checkPing(server.PingInterval, &server.PongWait)
+	if server.AcceptRate > 0 && server.AcceptBurst <= 0 {
+		server.AcceptBurst = int(math.Ceil(server.AcceptRate))
+		log.Release("invalid AcceptBurst, reset to %v", server.AcceptBurst)
+	}
+	limiter, err := newConnLimiter(server.MaxConnPerIP, server.AcceptRate, server.AcceptBurst, server.AllowCIDRs, server.DenyCIDRs)
+	if err != nil {
+		log.Fatal("%v", err)
+	}
 	if server.NewAgent == nil {
 		log.Fatal("NewAgent must not be nil")
 	}
@@ -118,14 +229,32 @@ func (server *WSServer) Start() {
 
 	server.ln = ln
 	server.handler = &WSHandler{
-		maxConnNum:      server.MaxConnNum,
-		pendingWriteNum: server.PendingWriteNum,
-		maxMsgLen:       server.MaxMsgLen,
-		newAgent:        server.NewAgent,
-		conns:           make(WebsocketConnSet),
+		maxConnNum:        server.MaxConnNum,
+		pendingWriteNum:   server.PendingWriteNum,
+		maxMsgLen:         server.MaxMsgLen,
+		firstMsgTimeout:   server.FirstMsgTimeout,
+		idleTimeout:       server.IdleTimeout,
+		pingInterval:      server.PingInterval,
+		pongWait:          server.PongWait,
+		textMessage:       server.TextMessage,
+		compressThreshold: server.CompressThreshold,
+		limiter:           limiter,
+		clientIP:          server.ClientIP,
+		overflow: overflow{
+			policy:     server.OverflowPolicy,
+			timeout:    server.OverflowTimeout,
+			key:        server.CoalesceKey,
+			onOverflow: server.OnOverflow,
+		},
+		newAgent: server.NewAgent,
+		onDrain:  server.OnDrain,
+		conns:    make(WebsocketConnSet),
+		agents:   make(map[Agent]struct{}),
 		upgrader: websocket.Upgrader{
-			HandshakeTimeout: server.HTTPTimeout,
-			CheckOrigin:      func(_ *http.Request) bool { return true },
+			HandshakeTimeout:  server.HTTPTimeout,
+			Subprotocols:      server.Subprotocols,
+			EnableCompression: server.EnableCompression,
+			CheckOrigin:       func(_ *http.Request) bool { return true },
 		},
 	}
 
@@ -152,3 +281,42 @@ func (server *WSServer) Close() {
 
 	server.handler.wg.Wait()
 }
+
+func (server *WSServer) Rejected() RejectStats {
+	return server.handler.limiter.stats()
+}
+
+// Drain stops accepting, calls OnDrain for every live agent, waits up to
+// timeout for the agents to disconnect and then closes the rest
+func (server *WSServer) Drain(timeout time.Duration) {
+	server.ln.Close()
+
+	server.handler.mutexConns.Lock()
+	server.handler.draining = true
+	agents := make([]Agent, 0, len(server.handler.agents))
+	for agent := range server.handler.agents {
+		agents = append(agents, agent)
+	}
+	server.handler.mutexConns.Unlock()
+
+	if server.OnDrain != nil {
+		for _, agent := range agents {
+			server.OnDrain(agent)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		server.handler.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		server.handler.mutexConns.Lock()
+		log.Release("drain timeout, close %v connections", len(server.handler.conns))
+		server.handler.mutexConns.Unlock()
+	}
+
+	server.Close()
+}
@@ -0,0 +1,302 @@
+package network
+
+import (
+	"github.com/gorilla/websocket"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// OnDrain is called for every live agent, one upgraded while Drain starts
+// included, and the agents left are closed at the timeout
+func TestWSServerDrain(t *testing.T) {
+	creating := make(chan struct{})
+	release := make(chan struct{})
+	agents := make(chan *drainAgent, 3)
+	drained := make(chan *drainAgent, 3)
+	n := 0
+	server := &WSServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *WSConn) Agent {
+			a := &drainAgent{conn: conn, done: make(chan struct{})}
+			n++
+			switch n {
+			case 1:
+				a.polite = true
+			case 3:
+				creating <- struct{}{}
+				<-release
+			}
+			agents <- a
+			return a
+		},
+		OnDrain: func(agent Agent) {
+			a := agent.(*drainAgent)
+			drained <- a
+			if a.polite {
+				a.conn.Close()
+			}
+		},
+	}
+	server.Start()
+
+	var live []*drainAgent
+	for i := 0; i < 3; i++ {
+		conn, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if i < 2 {
+			live = append(live, <-agents)
+		}
+	}
+	<-creating
+
+	drainDone := make(chan struct{})
+	go func() {
+		server.Drain(200 * time.Millisecond)
+		close(drainDone)
+	}()
+	for draining := false; !draining; time.Sleep(time.Millisecond) {
+		server.handler.mutexConns.Lock()
+		draining = server.handler.draining
+		server.handler.mutexConns.Unlock()
+	}
+	close(release)
+	live = append(live, <-agents)
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-drained:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%v agents drained, want 3", i)
+		}
+	}
+	select {
+	case <-drainDone:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Drain not returned")
+	}
+	for i, a := range live {
+		select {
+		case <-a.done:
+		default:
+			t.Fatalf("agent %v not closed", i)
+		}
+	}
+}
+
+func TestWSFrameType(t *testing.T) {
+	conns := make(chan *WSConn, 1)
+	server := &WSServer{
+		Addr:        "127.0.0.1:0",
+		TextMessage: true,
+		NewAgent: func(conn *WSConn) Agent {
+			conns <- conn
+			return &drainAgent{conn: conn, done: make(chan struct{})}
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	client, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-conns
+
+	// WriteMsg takes the type of the server, WriteMessage its own
+	conn.WriteMsg([]byte("text"))
+	conn.WriteMessage(websocket.BinaryMessage, []byte("binary"))
+	if err := conn.WriteMessage(websocket.PingMessage, []byte("ping")); err == nil {
+		t.Fatal("ping written as a message")
+	}
+	for _, want := range []struct {
+		msgType int
+		data    string
+	}{{websocket.TextMessage, "text"}, {websocket.BinaryMessage, "binary"}} {
+		msgType, b, err := client.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != want.msgType || string(b) != want.data {
+			t.Fatalf("read %v %q, want %v %q", msgType, b, want.msgType, want.data)
+		}
+	}
+}
+
+func TestWSReadMessageType(t *testing.T) {
+	conns := make(chan *WSConn, 1)
+	block := make(chan struct{})
+	server := &WSServer{
+		Addr: "127.0.0.1:0",
+		NewAgent: func(conn *WSConn) Agent {
+			conns <- conn
+			return blockAgent(block)
+		},
+	}
+	server.Start()
+	defer server.Close()
+	defer close(block)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn := <-conns
+
+	client.WriteMessage(websocket.TextMessage, []byte("text"))
+	client.WriteMessage(websocket.BinaryMessage, []byte("binary"))
+	for _, want := range []int{websocket.TextMessage, websocket.BinaryMessage} {
+		msgType, _, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msgType != want {
+			t.Fatalf("read frame type %v, want %v", msgType, want)
+		}
+	}
+}
+
+// the limits apply to the ip from ClientIP, denied requests get 403 and the
+// ones over the rate 429
+func TestWSServerLimits(t *testing.T) {
+	block := make(chan struct{})
+	server := &WSServer{
+		Addr:        "127.0.0.1:0",
+		AcceptRate:  0.001,
+		AcceptBurst: 1,
+		DenyCIDRs:   []string{"10.0.0.1"},
+		ClientIP: func(r *http.Request) string {
+			return r.Header.Get("X-Real-IP")
+		},
+		NewAgent: func(conn *WSConn) Agent {
+			return blockAgent(block)
+		},
+	}
+	server.Start()
+	defer server.Close()
+	defer close(block)
+
+	for _, c := range []struct {
+		ip     string
+		status int
+	}{{"10.0.0.1", 403}, {"10.0.0.2", 101}, {"10.0.0.3", 429}} {
+		header := http.Header{"X-Real-IP": {c.ip}}
+		conn, resp, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), header)
+		if conn != nil {
+			defer conn.Close()
+		}
+		if resp == nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != c.status {
+			t.Fatalf("%v got status %v, want %v", c.ip, resp.StatusCode, c.status)
+		}
+	}
+
+	stats := server.Rejected()
+	if stats.Denied != 1 || stats.RateLimited != 1 {
+		t.Fatalf("rejected %+v", stats)
+	}
+}
+
+// blockAgent leaves the conn to the test until closed
+type blockAgent chan struct{}
+
+func (a blockAgent) Run() {
+	<-a
+}
+
+func (a blockAgent) OnClose() {}
+
+// a peer not answering the pings is closed after PongWait, 2*PingInterval
+// if not set, one answering them lives on
+func TestWSPing(t *testing.T) {
+	agents := make(chan *readAgent, 2)
+	server := &WSServer{
+		Addr:         "127.0.0.1:0",
+		PingInterval: 50 * time.Millisecond,
+		NewAgent: func(conn *WSConn) Agent {
+			a := &readAgent{conn: conn, closed: make(chan struct{})}
+			agents <- a
+			return a
+		},
+	}
+	server.Start()
+	defer server.Close()
+
+	// gorilla clients answer pings while reading
+	alive, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer alive.Close()
+	go func() {
+		for {
+			if _, _, err := alive.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	aliveAgent := <-agents
+
+	start := time.Now()
+	dead, _, err := websocket.DefaultDialer.Dial("ws://"+server.ln.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	deadAgent := <-agents
+
+	select {
+	case <-deadAgent.closed:
+		if elapsed := time.Since(start); elapsed < server.PongWait {
+			t.Fatalf("dead peer closed after %v, PongWait %v", elapsed, server.PongWait)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("dead peer not closed")
+	}
+	select {
+	case <-aliveAgent.closed:
+		t.Fatal("alive peer closed")
+	case <-time.After(3 * server.PongWait):
+	}
+}
+
+// readAgent reads until the conn is broken
+type readAgent struct {
+	conn   *WSConn
+	closed chan struct{}
+}
+
+func (a *readAgent) Run() {
+	for {
+		if _, err := a.conn.ReadMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (a *readAgent) OnClose() {
+	close(a.closed)
+}
+
+func TestCheckPing(t *testing.T) {
+	for _, c := range []struct{ interval, wait, want time.Duration }{
+		{time.Second, 0, 2 * time.Second},
+		{time.Second, 3 * time.Second, 3 * time.Second},
+		{time.Second, time.Second, 2 * time.Second},
+		{time.Second, 500 * time.Millisecond, 2 * time.Second},
+		{0, 500 * time.Millisecond, 500 * time.Millisecond},
+	} {
+		wait := c.wait
+		checkPing(c.interval, &wait)
+		if wait != c.want {
+			t.Fatalf("PongWait %v with PingInterval %v reset to %v, want %v", c.wait, c.interval, wait, c.want)
+		}
+	}
+}
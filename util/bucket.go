@@ -0,0 +1,71 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is refilled at rate tokens per second and holds at most burst tokens
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	b := new(TokenBucket)
+	b.rate = rate
+	b.burst = float64(burst)
+	b.tokens = b.burst
+	return b
+}
+
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(time.Now(), 1)
+}
+
+// AllowN takes n tokens at now if there're enough
+func (b *TokenBucket) AllowN(now time.Time, n int) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Delay takes n tokens at now, going into debt if there aren't enough,
+// and returns how long to wait until the debt is paid
+func (b *TokenBucket) Delay(now time.Time, n int) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 || b.rate <= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if b.last.IsZero() {
+		b.last = now
+		return
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
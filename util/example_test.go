@@ -3,6 +3,7 @@ package util_test
 import (
 	"fmt"
 	"github.com/name5566/leaf/util"
+	"time"
 )
 
 func ExampleMap() {
@@ -90,3 +91,39 @@ func ExampleDeepClone() {
 	// 2
 	// 3
 }
+
+func ExampleTokenBucket() {
+	b := util.NewTokenBucket(1, 2)
+
+	now := time.Now()
+	fmt.Println(b.AllowN(now, 1))
+	fmt.Println(b.AllowN(now, 1))
+	fmt.Println(b.AllowN(now, 1))
+	fmt.Println(b.AllowN(now.Add(time.Second), 1))
+
+	// Output:
+	// true
+	// true
+	// false
+	// true
+}
+
+func ExampleTokenBucket_Delay() {
+	// 4 tokens per second, at most 2
+	b := util.NewTokenBucket(4, 2)
+	now := time.Now()
+
+	// Delay takes the tokens anyway and returns the wait for the debt
+	fmt.Println(b.Delay(now, 2))
+	fmt.Println(b.Delay(now, 3))
+	fmt.Println(b.Delay(now.Add(500*time.Millisecond), 1))
+	fmt.Println(b.AllowN(now.Add(500*time.Millisecond), 1))
+	fmt.Println(b.Delay(now.Add(2*time.Second), 1))
+
+	// Output:
+	// 0s
+	// 750ms
+	// 500ms
+	// false
+	// 0s
+}